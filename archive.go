@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	_ "github.com/rafaeljusto/contactme/Godeps/_workspace/src/github.com/mattn/go-sqlite3"
+)
+
+// Delivery status of the archived submissions
+const (
+	archiveStatusSending   = "sending"
+	archiveStatusSent      = "sent"
+	archiveStatusFailed    = "failed"
+	archiveStatusHeld      = "held"
+	archiveStatusRejected  = "rejected"
+	archiveStatusDiscarded = "discarded"
+	archiveStatusExpired   = "expired"
+)
+
+// archiveConfig stores where the submissions are archived. When the file is
+// empty the submissions aren't archived.
+type archiveConfig struct {
+	File string
+}
+
+// archiveDB is the database where all the submissions are stored, independent
+// of the delivery.
+var archiveDB *sql.DB
+
+// archiveMigrations are the changes of the database schema, applied in order
+// only once. New changes must be added at the end, never changing the
+// migrations already applied.
+var archiveMigrations = []string{
+	`CREATE TABLE submissions (
+		id           TEXT PRIMARY KEY,
+		form         TEXT NOT NULL,
+		ip           TEXT NOT NULL,
+		user_agent   TEXT NOT NULL,
+		referer      TEXT NOT NULL,
+		name         TEXT NOT NULL,
+		email        TEXT NOT NULL,
+		subject      TEXT NOT NULL,
+		message      TEXT NOT NULL,
+		language     TEXT NOT NULL,
+		fields       TEXT NOT NULL,
+		attachments  TEXT NOT NULL,
+		spam_score   REAL,
+		spam_details TEXT,
+		status       TEXT NOT NULL,
+		error        TEXT NOT NULL,
+		created_at   TEXT NOT NULL,
+		updated_at   TEXT NOT NULL,
+		delivered_at TEXT
+	);
+	CREATE INDEX submissions_created_at ON submissions (created_at);
+	CREATE INDEX submissions_email ON submissions (email);
+	CREATE INDEX submissions_status ON submissions (status);`,
+}
+
+// openArchive opens the database, creating it when it doesn't exist, and
+// applies the missing migrations.
+func openArchive(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows a single writer, so the connections wait for each other in
+	// the pool instead of failing with a locked database
+	db.SetMaxOpenConns(1)
+
+	if err := migrateArchive(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// migrateArchive applies the migrations that are newer than the version of
+// the database, each one in a transaction.
+func migrateArchive(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TEXT NOT NULL
+	)`); err != nil {
+		return err
+	}
+
+	var version int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+
+	if version > len(archiveMigrations) {
+		return fmt.Errorf("database version %d is newer than this service (%d)", version, len(archiveMigrations))
+	}
+
+	for i := version; i < len(archiveMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(archiveMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error applying migration %d. Details: %s", i+1, err)
+		}
+
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`,
+			i+1, archiveTime(time.Now())); err != nil {
+
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// archiveTime formats the timestamps, that are sorted as text.
+func archiveTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000Z")
+}
+
+// archive stores the submission with its delivery status. Failures are only
+// logged, as the archive never blocks the delivery.
+func (f *form) archive(r *http.Request, ip string, input submission, status, errMessage string) {
+	if archiveDB == nil {
+		return
+	}
+
+	fields, err := json.Marshal(input.Fields)
+	if err != nil {
+		log.Printf("error archiving submission “%s”. Details: %s", input.ID, err)
+		return
+	}
+
+	attachments := input.Attachments
+	if attachments == nil {
+		attachments = []attachment{}
+	}
+
+	attachmentsJSON, err := json.Marshal(attachments)
+	if err != nil {
+		log.Printf("error archiving submission “%s”. Details: %s", input.ID, err)
+		return
+	}
+
+	var spamScore, spamDetails interface{}
+	if input.Spam != nil {
+		spamScore, spamDetails = input.Spam.Score, strings.Join(input.Spam.Details, ", ")
+	}
+
+	now := archiveTime(time.Now())
+	var deliveredAt interface{}
+	if status == archiveStatusSent {
+		deliveredAt = now
+	}
+
+	_, err = archiveDB.Exec(`INSERT INTO submissions (id, form, ip, user_agent, referer, name, email,
+		subject, message, language, fields, attachments, spam_score, spam_details, status, error,
+		created_at, updated_at, delivered_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		input.ID, f.ID, ip, r.UserAgent(), r.Referer(), input.Name, input.Email, input.Subject,
+		input.Message, input.Language, string(fields), string(attachmentsJSON), spamScore,
+		spamDetails, status, errMessage, now, now, deliveredAt)
+
+	if err != nil {
+		log.Printf("error archiving submission “%s”. Details: %s", input.ID, err)
+	}
+}
+
+// archiveStatus updates the delivery status of an archived submission.
+func archiveStatus(id, status, errMessage string) {
+	if archiveDB == nil {
+		return
+	}
+
+	now := archiveTime(time.Now())
+	var deliveredAt interface{}
+	if status == archiveStatusSent {
+		deliveredAt = now
+	}
+
+	_, err := archiveDB.Exec(`UPDATE submissions SET status = ?, error = ?, updated_at = ?,
+		delivered_at = COALESCE(?, delivered_at) WHERE id = ?`, status, errMessage, now, deliveredAt, id)
+
+	if err != nil {
+		log.Printf("error archiving status of submission “%s”. Details: %s", id, err)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// attachmentsConfig stores the limits of the files uploaded with the form and
+// where they go.
+type attachmentsConfig struct {
+	MaxFiles     int        `yaml:"max files"`
+	MaxFileSize  byteSize   `yaml:"max file size"`
+	MaxTotalSize byteSize   `yaml:"max total size"`
+	AllowedTypes stringList `yaml:"allowed types"`
+	Storage      string
+	Directory    string
+	Retention    time.Duration
+}
+
+// allowed checks if the content type detected in the file is in the allowed
+// list. The list accepts wildcards for subtypes (e.g. image/*), and when it is
+// empty any content type is allowed.
+func (a attachmentsConfig) allowed(contentType string) bool {
+	if len(a.AllowedTypes) == 0 {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, allowedType := range a.AllowedTypes {
+		allowedType = strings.ToLower(strings.TrimSpace(allowedType))
+		if allowedType == mediaType {
+			return true
+		}
+
+		if strings.HasSuffix(allowedType, "/*") &&
+			strings.HasPrefix(mediaType, strings.TrimSuffix(allowedType, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// attachment is a file uploaded by the client, stored in a temporary file
+// until the e-mail is sent.
+type attachment struct {
+	Field       string `json:"field"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Path        string `json:"-"`
+
+	// Download link when the file is stored on disk
+	Token   string    `json:"-"`
+	URL     string    `json:"-"`
+	Expires time.Time `json:"-"`
+}
+
+// readMultipartBody reads a multipart body part by part, so the files are
+// streamed to temporary files instead of being kept in memory. The text fields
+// are converted to form values, so they can be read in the same way of a
+// form-encoded body. Problems with the files are added to the validation
+// errors.
+func (f *form) readMultipartBody(r *http.Request, errs validationError) ([]attachment, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return nil, nil
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, validationError{"body": "invalid multipart body"}
+	}
+
+	values := make(url.Values)
+	var attachments []attachment
+	var valuesSize, totalSize int64
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+
+		} else if err != nil {
+			removeAttachments(attachments)
+			return nil, validationError{"body": "invalid multipart body"}
+		}
+
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+
+		if part.FileName() == "" {
+			data, err := io.ReadAll(io.LimitReader(part, maxFormValuesSize-valuesSize+1))
+			if err != nil {
+				removeAttachments(attachments)
+				return nil, validationError{"body": "invalid multipart body"}
+			}
+
+			if valuesSize += int64(len(data)); valuesSize > maxFormValuesSize {
+				removeAttachments(attachments)
+				return nil, validationError{"body": "fields too large"}
+			}
+
+			values.Add(name, string(data))
+			continue
+		}
+
+		if len(attachments) >= f.Attachments.MaxFiles {
+			if f.Attachments.MaxFiles == 0 {
+				errs[name] = "attachments not allowed"
+			} else {
+				errs[name] = fmt.Sprintf("at most %d files are allowed", f.Attachments.MaxFiles)
+			}
+			continue
+		}
+
+		maxSize := int64(f.Attachments.MaxFileSize)
+		if remaining := int64(f.Attachments.MaxTotalSize) - totalSize; remaining < maxSize {
+			maxSize = remaining
+		}
+
+		file, message, err := f.saveAttachment(part, maxSize)
+		if err != nil {
+			removeAttachments(attachments)
+			return nil, err
+
+		} else if message != "" {
+			errs[name] = message
+			continue
+		}
+
+		totalSize += file.Size
+		attachments = append(attachments, file)
+	}
+
+	r.Form = values
+	r.PostForm = values
+	return attachments, nil
+}
+
+// saveAttachment copies the uploaded file to a temporary file, checking its
+// size and the content type detected from the file content (the content type
+// informed by the client is ignored), and scanning it with the antivirus. It
+// returns the error message when the file isn't accepted.
+func (f *form) saveAttachment(part *multipart.Part, maxSize int64) (attachment, string, error) {
+	file, err := os.CreateTemp("", "contactme-")
+	if err != nil {
+		return attachment{}, "", err
+	}
+
+	a := attachment{
+		Field:    part.FormName(),
+		Filename: normalizeInput(filepath.Base(filepath.Clean("/" + part.FileName()))),
+		Path:     file.Name(),
+	}
+
+	a.Size, err = io.Copy(file, io.LimitReader(part, maxSize+1))
+	if err != nil {
+		file.Close()
+		os.Remove(a.Path)
+		return attachment{}, "", err
+	}
+
+	if a.Size > maxSize {
+		file.Close()
+		os.Remove(a.Path)
+
+		if maxSize < int64(f.Attachments.MaxFileSize) {
+			return attachment{}, "attachments too large", nil
+		}
+		return attachment{}, "file too large", nil
+	}
+
+	sniff := make([]byte, 512)
+	n, err := file.ReadAt(sniff, 0)
+	if err != nil && err != io.EOF {
+		file.Close()
+		os.Remove(a.Path)
+		return attachment{}, "", err
+	}
+	a.ContentType = http.DetectContentType(sniff[:n])
+
+	if err := file.Close(); err != nil {
+		os.Remove(a.Path)
+		return attachment{}, "", err
+	}
+
+	if !f.Attachments.allowed(a.ContentType) {
+		os.Remove(a.Path)
+		return attachment{}, "file type not allowed", nil
+	}
+
+	if config.Clamd.Address == "" {
+		return a, "", nil
+	}
+
+	virus, err := config.Clamd.scan(a.Path)
+	if err != nil {
+		if config.Clamd.FailOpen {
+			log.Printf("error scanning attachment “%s”, accepting it anyway. Details: %s", a.Filename, err)
+			return a, "", nil
+		}
+
+		os.Remove(a.Path)
+		return attachment{}, "", fmt.Errorf("%w. Details: %s", errScannerUnavailable, err)
+	}
+
+	if virus != "" {
+		log.Printf("infected attachment “%s” rejected (%s)", a.Filename, virus)
+		os.Remove(a.Path)
+		return attachment{}, fmt.Sprintf("infected file (%s)", virus), nil
+	}
+
+	return a, "", nil
+}
+
+// removeAttachments removes the temporary files of the attachments.
+func removeAttachments(attachments []attachment) {
+	for _, a := range attachments {
+		if err := os.Remove(a.Path); err != nil && !os.IsNotExist(err) {
+			log.Printf("error removing attachment “%s”. Details: %s", a.Path, err)
+		}
+	}
+}
+
+// writeAttachment adds the attachment as a part of the multipart e-mail.
+func writeAttachment(w *multipart.Writer, a attachment) error {
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", mime.FormatMediaType(strings.SplitN(a.ContentType, ";", 2)[0],
+		map[string]string{"name": a.Filename}))
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": a.Filename}))
+	header.Set("Content-Transfer-Encoding", "base64")
+
+	partWriter, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(a.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	encoder := base64.NewEncoder(base64.StdEncoding, &lineWrapper{w: partWriter})
+	if _, err := io.Copy(encoder, file); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// lineWrapper breaks the base64 content in lines of 76 characters, as
+// required by the MIME specification.
+type lineWrapper struct {
+	w      io.Writer
+	column int
+}
+
+func (l *lineWrapper) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		chunk := 76 - l.column
+		if chunk > len(data) {
+			chunk = len(data)
+		}
+
+		n, err := l.w.Write(data[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		data = data[chunk:]
+		if l.column += chunk; l.column == 76 {
+			if _, err := l.w.Write([]byte("\r\n")); err != nil {
+				return written, err
+			}
+			l.column = 0
+		}
+	}
+	return written, nil
+}
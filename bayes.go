@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// feedbackPath is where the links to mark a delivered message as spam or ham
+// are served, followed by the submission identifier.
+const feedbackPath = "/feedback/"
+
+// Labels of the trained messages
+const (
+	bayesLabelSpam = "spam"
+	bayesLabelHam  = "ham"
+)
+
+// bayesInterestingTokens is the number of tokens, the ones that most indicate
+// spam or ham, used to classify a message.
+const bayesInterestingTokens = 15
+
+// bayesConfig stores where the classifier is persisted and how much its
+// probability weighs in the spam score. When the file is empty the classifier
+// isn't used.
+type bayesConfig struct {
+	File              string
+	Weight            float64
+	FeedbackDirectory string        `yaml:"feedback directory"`
+	FeedbackExpires   time.Duration `yaml:"feedback expires"`
+}
+
+// bayesClassifier is a naive-Bayes classifier that counts in how many spam
+// and ham messages each token appeared.
+type bayesClassifier struct {
+	SpamMessages int            `json:"spam_messages"`
+	HamMessages  int            `json:"ham_messages"`
+	Spam         map[string]int `json:"spam"`
+	Ham          map[string]int `json:"ham"`
+
+	path string
+	lock sync.RWMutex
+
+	// saveLock serializes the saves, that share the same temporary file and
+	// must be renamed in the same order that they were marshaled
+	saveLock sync.Mutex
+}
+
+// loadClassifier reads the classifier from the file. When the file doesn't
+// exist yet the classifier starts untrained.
+func loadClassifier(path string) (*bayesClassifier, error) {
+	b := &bayesClassifier{
+		Spam: make(map[string]int),
+		Ham:  make(map[string]int),
+		path: path,
+	}
+
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, b); err != nil {
+		return nil, fmt.Errorf("invalid classifier file “%s”. Details: %s", path, err)
+	}
+
+	if b.Spam == nil {
+		b.Spam = make(map[string]int)
+	}
+
+	if b.Ham == nil {
+		b.Ham = make(map[string]int)
+	}
+
+	return b, nil
+}
+
+// train counts the tokens of the message as spam or ham.
+func (b *bayesClassifier) train(text string, spam bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	counts := b.Ham
+	if spam {
+		counts = b.Spam
+		b.SpamMessages++
+	} else {
+		b.HamMessages++
+	}
+
+	for _, token := range tokenize(text) {
+		counts[token]++
+	}
+}
+
+// save writes the classifier in a temporary file first, so the file is never
+// left incomplete.
+func (b *bayesClassifier) save() error {
+	b.saveLock.Lock()
+	defer b.saveLock.Unlock()
+
+	b.lock.RLock()
+	content, err := json.Marshal(b)
+	b.lock.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	tmpPath := b.path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0600); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, b.path)
+}
+
+// probability returns the chance of the message being spam, combining the
+// tokens that most indicate spam or ham (Robinson's method). When the
+// classifier doesn't know spam and ham messages yet the result is neutral.
+func (b *bayesClassifier) probability(text string) float64 {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if b.SpamMessages == 0 || b.HamMessages == 0 {
+		return 0.5
+	}
+
+	var probabilities []float64
+	for _, token := range tokenize(text) {
+		spam, ham := b.Spam[token], b.Ham[token]
+		if spam+ham == 0 {
+			continue
+		}
+
+		spamRatio := math.Min(1, float64(spam)/float64(b.SpamMessages))
+		hamRatio := math.Min(1, float64(ham)/float64(b.HamMessages))
+		p := spamRatio / (spamRatio + hamRatio)
+
+		// rare tokens stay close to neutral
+		n := float64(spam + ham)
+		p = (0.5 + n*p) / (1 + n)
+		probabilities = append(probabilities, math.Max(0.01, math.Min(0.99, p)))
+	}
+
+	if len(probabilities) == 0 {
+		return 0.5
+	}
+
+	sort.Slice(probabilities, func(i, j int) bool {
+		return math.Abs(probabilities[i]-0.5) > math.Abs(probabilities[j]-0.5)
+	})
+
+	if len(probabilities) > bayesInterestingTokens {
+		probabilities = probabilities[:bayesInterestingTokens]
+	}
+
+	var logSpam, logHam float64
+	for _, p := range probabilities {
+		logSpam += math.Log(p)
+		logHam += math.Log(1 - p)
+	}
+	return 1 / (1 + math.Exp(logHam-logSpam))
+}
+
+// tokenize splits the text in lower case words, without repetitions.
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '$' && r != '-' && r != '\''
+	})
+
+	var tokens []string
+	seen := make(map[string]bool)
+	for _, word := range words {
+		if len(word) < 3 || len(word) > 30 || seen[word] {
+			continue
+		}
+		seen[word] = true
+		tokens = append(tokens, word)
+	}
+	return tokens
+}
+
+// bayesRule scores the submission with the probability given by the
+// classifier, when it is more likely spam than ham.
+type bayesRule struct {
+	Weight float64
+}
+
+func (b bayesRule) name() string {
+	return "bayes"
+}
+
+func (b bayesRule) check(input submission) float64 {
+	if classifier == nil {
+		return 0
+	}
+
+	p := classifier.probability(input.Subject + "\n" + input.Message)
+	if p <= 0.5 {
+		return 0
+	}
+	return b.Weight * (p - 0.5) * 2
+}
+
+// storeFeedback keeps the submission text until the feedback links expire,
+// so the classifier can learn from it later, and returns the signed links.
+func storeFeedback(input submission) (map[string]string, error) {
+	path := filepath.Join(config.Bayes.FeedbackDirectory, input.ID)
+	if err := os.WriteFile(path, []byte(input.Subject+"\n"+input.Message), 0600); err != nil {
+		return nil, err
+	}
+
+	expires := strconv.FormatInt(time.Now().Add(config.Bayes.FeedbackExpires).Unix(), 10)
+
+	links := make(map[string]string)
+	for _, label := range []string{bayesLabelSpam, bayesLabelHam} {
+		query := make(url.Values)
+		query.Set("label", label)
+		query.Set("expires", expires)
+		query.Set("signature", sign("feedback", input.ID, label, expires))
+
+		links[label] = strings.TrimRight(config.URL, "/") + feedbackPath + input.ID + "?" + query.Encode()
+	}
+
+	return links, nil
+}
+
+// removeFeedback removes the submission text when the e-mail wasn't
+// delivered.
+func removeFeedback(id string) {
+	path := filepath.Join(config.Bayes.FeedbackDirectory, id)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("error removing feedback “%s”. Details: %s", path, err)
+	}
+}
+
+// removeExpiredFeedback removes the submission texts older than the feedback
+// links.
+func removeExpiredFeedback() {
+	if classifier == nil {
+		return
+	}
+
+	entries, err := os.ReadDir(config.Bayes.FeedbackDirectory)
+	if err != nil {
+		log.Printf("error reading feedback directory “%s”. Details: %s", config.Bayes.FeedbackDirectory, err)
+		return
+	}
+
+	for _, entry := range entries {
+		if !submissionIDFormat.MatchString(entry.Name()) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) <= config.Bayes.FeedbackExpires {
+			continue
+		}
+
+		removeFeedback(entry.Name())
+	}
+}
+
+// handleFeedback trains the classifier with a delivered message. The link
+// first shows a confirmation page, as some mail clients and scanners open the
+// links of the messages automatically, and the message is only learned when
+// the page is submitted. Each message can only be learned once.
+func handleFeedback(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, feedbackPath)
+	if classifier == nil || !submissionIDFormat.MatchString(id) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	label, expires := query.Get("label"), query.Get("expires")
+	if (label != bayesLabelSpam && label != bayesLabelHam) ||
+		!validSignature(query.Get("signature"), "feedback", id, label, expires) {
+
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if expiresAt, err := strconv.ParseInt(expires, 10, 64); err != nil || time.Now().Unix() > expiresAt {
+		feedbackPage(w, http.StatusGone, "This link expired.")
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		feedbackPage(w, http.StatusOK, fmt.Sprintf(`Mark the message as %s?
+<form method="post" action="%s"><button type="submit">Confirm</button></form>`,
+			label, html.EscapeString(r.URL.RequestURI())))
+		return
+
+	case "POST":
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := filepath.Join(config.Bayes.FeedbackDirectory, id)
+	text, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		feedbackPage(w, http.StatusGone, "This message was already marked or expired.")
+		return
+
+	} else if err != nil {
+		log.Printf("error reading feedback “%s”. Details: %s", path, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// the text is removed first, so concurrent requests don't learn the
+	// message twice
+	if err := os.Remove(path); err != nil {
+		feedbackPage(w, http.StatusGone, "This message was already marked or expired.")
+		return
+	}
+
+	classifier.train(string(text), label == bayesLabelSpam)
+	if err := classifier.save(); err != nil {
+		log.Printf("error saving classifier “%s”. Details: %s", config.Bayes.File, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("submission “%s” marked as %s", id, label)
+	feedbackPage(w, http.StatusOK, fmt.Sprintf("Thanks, the message was marked as %s.", label))
+}
+
+func feedbackPage(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><title>ContactMe</title></head><body>\n%s\n</body></html>\n", body)
+}
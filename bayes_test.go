@@ -0,0 +1,154 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBayesClassifierConcurrentSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bayes.json")
+
+	classifier, err := loadClassifier(path)
+	if err != nil {
+		t.Fatalf("unexpected error loading classifier. Details: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			classifier.train("buy cheap pills now", i%2 == 0)
+			if err := classifier.save(); err != nil {
+				t.Errorf("unexpected error saving classifier. Details: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	loaded, err := loadClassifier(path)
+	if err != nil {
+		t.Fatalf("unexpected error loading saved classifier. Details: %s", err)
+	}
+
+	if loaded.SpamMessages != 10 || loaded.HamMessages != 10 {
+		t.Errorf("unexpected messages in saved classifier: %d spam and %d ham",
+			loaded.SpamMessages, loaded.HamMessages)
+	}
+}
+
+func TestBayesRuleUsedByForms(t *testing.T) {
+	originalURL, originalTransport, originalMaildir := config.URL, config.Transport, config.Maildir.Path
+	originalMailbox, originalSpam, originalBayes := config.Mailbox, config.Spam, config.Bayes
+	originalForms, originalClassifier, originalDelivery := forms, classifier, deliveryTransport
+	t.Cleanup(func() {
+		config.URL, config.Transport, config.Maildir.Path = originalURL, originalTransport, originalMaildir
+		config.Mailbox, config.Spam, config.Bayes = originalMailbox, originalSpam, originalBayes
+		forms, classifier, deliveryTransport = originalForms, originalClassifier, originalDelivery
+	})
+
+	trained := trainedClassifier(t)
+	if err := trained.save(); err != nil {
+		t.Fatalf("unexpected error saving classifier. Details: %s", err)
+	}
+
+	dir := t.TempDir()
+	config.URL = "http://localhost"
+	config.Transport = stringList{transportMaildir}
+	config.Maildir.Path = filepath.Join(dir, "maildir")
+	config.Mailbox = mailbox{To: stringList{"me@example.com"}}
+	config.Spam = spamConfig{TagScore: 1}
+	config.Bayes = bayesConfig{File: trained.path, Weight: 5}
+
+	// the same steps of the service start, before the storage is prepared
+	fillConfigurationDefaults()
+	validateConfiguration()
+
+	result := forms[0].Spam.evaluate(submission{Subject: "cheap pills", Message: "casino winner"})
+	if result.Score < 1 || len(result.Details) == 0 || !strings.HasPrefix(result.Details[0], "bayes=") {
+		t.Errorf("classifier not used in the spam score: %s", result)
+	}
+}
+
+// trainedClassifier returns a classifier that knows some spam and ham
+// messages.
+func trainedClassifier(t *testing.T) *bayesClassifier {
+	b, err := loadClassifier(filepath.Join(t.TempDir(), "bayes.json"))
+	if err != nil {
+		t.Fatalf("unexpected error loading classifier. Details: %s", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		b.train("cheap pills casino winner", true)
+		b.train("meeting tomorrow about the project", false)
+	}
+	return b
+}
+
+func TestBayesClassifierProbability(t *testing.T) {
+	untrained, err := loadClassifier(filepath.Join(t.TempDir(), "bayes.json"))
+	if err != nil {
+		t.Fatalf("unexpected error loading classifier. Details: %s", err)
+	}
+
+	if p := untrained.probability("cheap pills"); p != 0.5 {
+		t.Errorf("unexpected probability %.2f of untrained classifier", p)
+	}
+
+	b := trainedClassifier(t)
+	if p := b.probability("casino winner"); p <= 0.9 {
+		t.Errorf("unexpected probability %.2f of spam message", p)
+	}
+
+	if p := b.probability("project meeting"); p >= 0.1 {
+		t.Errorf("unexpected probability %.2f of ham message", p)
+	}
+}
+
+func TestBayesRuleCheck(t *testing.T) {
+	originalClassifier := classifier
+	t.Cleanup(func() { classifier = originalClassifier })
+
+	rule := bayesRule{Weight: 5}
+
+	classifier = nil
+	if score := rule.check(submission{Subject: "cheap pills"}); score != 0 {
+		t.Errorf("unexpected score %.2f without classifier", score)
+	}
+
+	classifier = trainedClassifier(t)
+	if score := rule.check(submission{Subject: "cheap pills", Message: "casino winner"}); score < 4 || score > 5 {
+		t.Errorf("unexpected score %.2f of spam message", score)
+	}
+
+	if score := rule.check(submission{Subject: "project", Message: "meeting tomorrow"}); score != 0 {
+		t.Errorf("unexpected score %.2f of ham message", score)
+	}
+}
+
+func TestSpamScoreWithBayes(t *testing.T) {
+	originalClassifier, originalBayes := classifier, config.Bayes
+	t.Cleanup(func() { classifier, config.Bayes = originalClassifier, originalBayes })
+
+	config.Bayes = bayesConfig{File: "bayes.json", Weight: 5}
+
+	// the rule is kept even when the classifier is loaded after the forms
+	classifier = nil
+	s := spamConfig{TagScore: 3, Rules: spamRules{Links: linksRule{Max: 0, Score: 1}}}
+	if err := s.prepare(); err != nil {
+		t.Fatalf("unexpected error preparing spam rules. Details: %s", err)
+	}
+	classifier = trainedClassifier(t)
+
+	result := s.evaluate(submission{Subject: "cheap pills", Message: "casino winner http://example.com"})
+	if result.Score < 5 || result.Score > 6 {
+		t.Errorf("unexpected spam score %s", result)
+	}
+
+	if len(result.Details) != 2 || !strings.HasPrefix(result.Details[1], "bayes=") || result.Tag == "" {
+		t.Errorf("unexpected spam details %s (tag “%s”)", result, result.Tag)
+	}
+}
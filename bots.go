@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tokenPath is where the forms issue the tokens that record when the form was
+// loaded, followed by the form identifier.
+const tokenPath = "/token/"
+
+// botTokenField is the hidden field that carries the token issued when the
+// form was loaded.
+const botTokenField = "_token"
+
+// botDetectionConfig stores the traps for bots. Submissions caught by them
+// are discarded, but the bot still receives a success answer.
+type botDetectionConfig struct {
+	Honeypot    string
+	MinFillTime time.Duration `yaml:"min fill time"`
+	MaxAge      time.Duration `yaml:"max age"`
+}
+
+// newBotToken signs the current time, so the form can check later how long the
+// client took to fill it.
+func (f *form) newBotToken() string {
+	issued := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	return issued + "." + sign("token", f.ID, issued)
+}
+
+// detectBot checks the honeypot field and the time spent filling the form,
+// returning why the submission looks like it was sent by a bot. The tokens
+// older than the maximum age are also rejected.
+func (f *form) detectBot(r *http.Request) string {
+	if f.BotDetection.Honeypot != "" && r.FormValue(f.BotDetection.Honeypot) != "" {
+		return "honeypot field filled"
+	}
+
+	if f.BotDetection.MinFillTime == 0 {
+		return ""
+	}
+
+	token := strings.SplitN(r.FormValue(botTokenField), ".", 2)
+	if len(token) != 2 || !validSignature(token[1], "token", f.ID, token[0]) {
+		return "missing or invalid token"
+	}
+
+	issued, err := strconv.ParseInt(token[0], 10, 64)
+	if err != nil {
+		return "missing or invalid token"
+	}
+
+	elapsed := time.Since(time.Unix(0, issued*int64(time.Millisecond)))
+	if elapsed < f.BotDetection.MinFillTime {
+		return "form filled in " + elapsed.Round(time.Millisecond).String()
+	}
+
+	// old tokens are probably being reused by a bot
+	if elapsed > f.BotDetection.MaxAge {
+		return "token expired " + (elapsed - f.BotDetection.MaxAge).Round(time.Second).String() + " ago"
+	}
+
+	return ""
+}
+
+// handleToken issues a new token for the form, that must be sent back in the
+// "_token" field.
+func (f *form) handleToken(w http.ResponseWriter, r *http.Request) {
+	if !f.handleCORS(w, r) {
+		return
+	}
+
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	err := json.NewEncoder(w).Encode(struct {
+		Token string `json:"token"`
+	}{
+		Token: f.newBotToken(),
+	})
+
+	if err != nil {
+		log.Println("error writing response. Details:", err)
+	}
+}
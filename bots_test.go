@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetectBotToken(t *testing.T) {
+	originalSecret := secret
+	t.Cleanup(func() { secret = originalSecret })
+	secret = []byte("secret")
+
+	f := &form{
+		ID: "default",
+		BotDetection: botDetectionConfig{
+			MinFillTime: 2 * time.Second,
+			MaxAge:      time.Hour,
+		},
+	}
+
+	// token issued some time ago
+	token := func(age time.Duration) string {
+		issued := strconv.FormatInt(time.Now().Add(-age).UnixNano()/int64(time.Millisecond), 10)
+		return issued + "." + sign("token", f.ID, issued)
+	}
+
+	scenarios := []struct {
+		token    string
+		expected string
+	}{
+		{token: token(time.Minute), expected: ""},
+		{token: "", expected: "missing or invalid token"},
+		{token: strings.Replace(token(time.Minute), ".", "0.", 1), expected: "missing or invalid token"},
+		{token: token(0), expected: "form filled in"},
+		{token: token(2 * time.Hour), expected: "token expired 1h0m0s ago"},
+	}
+
+	for _, scenario := range scenarios {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(url.Values{botTokenField: {scenario.token}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		reason := f.detectBot(r)
+		if (scenario.expected == "") != (reason == "") || !strings.HasPrefix(reason, scenario.expected) {
+			t.Errorf("unexpected reason “%s” for token “%s” (expected “%s”)", reason, scenario.token, scenario.expected)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Supported CAPTCHA providers
+const (
+	captchaReCAPTCHA = "recaptcha"
+	captchaHCaptcha  = "hcaptcha"
+	captchaTurnstile = "turnstile"
+)
+
+// captchaProviders stores the field where each provider widget puts the token
+// and the default address to verify it.
+var captchaProviders = map[string]struct {
+	field     string
+	verifyURL string
+}{
+	captchaReCAPTCHA: {"g-recaptcha-response", "https://www.google.com/recaptcha/api/siteverify"},
+	captchaHCaptcha:  {"h-captcha-response", "https://api.hcaptcha.com/siteverify"},
+	captchaTurnstile: {"cf-turnstile-response", "https://challenges.cloudflare.com/turnstile/v0/siteverify"},
+}
+
+// captchaConfig stores how the CAPTCHA token sent with the form is verified.
+// When the provider is empty there's no verification.
+type captchaConfig struct {
+	Provider  string
+	Secret    string
+	Field     string
+	VerifyURL string  `yaml:"verify url"`
+	MinScore  float64 `yaml:"min score"`
+	Hostnames stringList
+	Action    string
+	Timeout   time.Duration
+	FailOpen  bool `yaml:"fail open"`
+}
+
+// prepare checks the provider and fills the token field and verify address
+// when missing.
+func (c *captchaConfig) prepare() error {
+	if c.Provider = strings.ToLower(strings.TrimSpace(c.Provider)); c.Provider == "" {
+		return nil
+	}
+
+	provider, ok := captchaProviders[c.Provider]
+	if !ok {
+		return fmt.Errorf("unknown CAPTCHA provider “%s”", c.Provider)
+	}
+
+	if c.Secret == "" {
+		return fmt.Errorf("missing secret of the CAPTCHA provider “%s”", c.Provider)
+	}
+
+	if c.Field = strings.TrimSpace(c.Field); c.Field == "" {
+		c.Field = provider.field
+	}
+
+	if c.VerifyURL = strings.TrimSpace(c.VerifyURL); c.VerifyURL == "" {
+		c.VerifyURL = provider.verifyURL
+	}
+
+	if _, err := url.Parse(c.VerifyURL); err != nil {
+		return fmt.Errorf("invalid CAPTCHA verify URL “%s”. Details: %s", c.VerifyURL, err)
+	}
+
+	if c.Timeout.Seconds() == 0 {
+		c.Timeout = defaultCaptchaTimeout
+	}
+
+	return nil
+}
+
+// check verifies the token applying the fail open policy: when the provider
+// couldn't answer the error is only returned if the submissions must be
+// rejected, otherwise the token is accepted.
+func (c captchaConfig) check(token, ip string) (string, error) {
+	reason, err := c.verify(token, ip)
+	if err != nil && c.FailOpen {
+		log.Println("error verifying CAPTCHA, accepting the submission anyway. Details:", err)
+		return "", nil
+	}
+	return reason, err
+}
+
+// verify asks the provider if the token is valid, returning why the token was
+// rejected. An error is returned when the provider couldn't answer.
+func (c captchaConfig) verify(token, ip string) (string, error) {
+	if token == "" {
+		return "missing token", nil
+	}
+
+	client := http.Client{Timeout: c.Timeout}
+	response, err := client.PostForm(c.VerifyURL, url.Values{
+		"secret":   {c.Secret},
+		"response": {token},
+		"remoteip": {ip},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d from the CAPTCHA provider", response.StatusCode)
+	}
+
+	var result struct {
+		Success    bool     `json:"success"`
+		Score      *float64 `json:"score"`
+		Action     string   `json:"action"`
+		Hostname   string   `json:"hostname"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&result); err != nil {
+		return "", errors.New("invalid response from the CAPTCHA provider. Details: " + err.Error())
+	}
+
+	if !result.Success {
+		return "rejected by the provider (" + strings.Join(result.ErrorCodes, ", ") + ")", nil
+	}
+
+	// the score is only sent by reCAPTCHA v3, where 1.0 is very likely a human
+	if c.Provider == captchaReCAPTCHA && c.MinScore > 0 && result.Score != nil && *result.Score < c.MinScore {
+		return fmt.Sprintf("score %.2f below the minimum", *result.Score), nil
+	}
+
+	if len(c.Hostnames) > 0 {
+		matched := false
+		for _, pattern := range c.Hostnames {
+			if matchDomain(strings.ToLower(result.Hostname), strings.ToLower(pattern)) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return "hostname “" + result.Hostname + "” not allowed", nil
+		}
+	}
+
+	if c.Action != "" && result.Action != c.Action {
+		return "unexpected action “" + result.Action + "”", nil
+	}
+
+	return "", nil
+}
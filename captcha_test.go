@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeCaptchaProvider answers the verifications with the response of each
+// token, checking the secret and the client IP sent.
+func fakeCaptchaProvider(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("secret") != "secret" || r.FormValue("remoteip") != "192.0.2.1" {
+			fmt.Fprint(w, `{"success": false, "error-codes": ["invalid-input-secret"]}`)
+			return
+		}
+
+		switch r.FormValue("response") {
+		case "valid":
+			fmt.Fprint(w, `{"success": true, "score": 0.9, "action": "contact", "hostname": "www.example.com"}`)
+		case "rejected":
+			fmt.Fprint(w, `{"success": false, "error-codes": ["invalid-input-response", "timeout-or-duplicate"]}`)
+		case "low-score":
+			fmt.Fprint(w, `{"success": true, "score": 0.1, "action": "contact", "hostname": "www.example.com"}`)
+		case "other-hostname":
+			fmt.Fprint(w, `{"success": true, "score": 0.9, "action": "contact", "hostname": "attacker.example"}`)
+		case "other-action":
+			fmt.Fprint(w, `{"success": true, "score": 0.9, "action": "login", "hostname": "www.example.com"}`)
+		case "unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "invalid-json":
+			fmt.Fprint(w, `{"success": tru`)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCaptchaVerify(t *testing.T) {
+	server := fakeCaptchaProvider(t)
+
+	c := captchaConfig{
+		Provider:  captchaReCAPTCHA,
+		Secret:    "secret",
+		VerifyURL: server.URL,
+		MinScore:  0.5,
+		Hostnames: stringList{"*.example.com"},
+		Action:    "contact",
+		Timeout:   time.Second,
+	}
+
+	scenarios := []struct {
+		token    string
+		expected string
+		err      bool
+	}{
+		{token: "valid"},
+		{token: "", expected: "missing token"},
+		{token: "rejected", expected: "rejected by the provider (invalid-input-response, timeout-or-duplicate)"},
+		{token: "low-score", expected: "score 0.10 below the minimum"},
+		{token: "other-hostname", expected: "hostname “attacker.example” not allowed"},
+		{token: "other-action", expected: "unexpected action “login”"},
+		{token: "unavailable", err: true},
+		{token: "invalid-json", err: true},
+	}
+
+	for _, scenario := range scenarios {
+		reason, err := c.verify(scenario.token, "192.0.2.1")
+		if scenario.err != (err != nil) {
+			t.Errorf("unexpected error for token “%s”: %v", scenario.token, err)
+		}
+
+		if reason != scenario.expected {
+			t.Errorf("unexpected reason for token “%s”: “%s” (expected “%s”)", scenario.token, reason, scenario.expected)
+		}
+	}
+}
+
+func TestCaptchaScoreOnlyForReCAPTCHA(t *testing.T) {
+	server := fakeCaptchaProvider(t)
+
+	c := captchaConfig{Provider: captchaHCaptcha, Secret: "secret", VerifyURL: server.URL, MinScore: 0.5, Timeout: time.Second}
+	if reason, err := c.verify("low-score", "192.0.2.1"); reason != "" || err != nil {
+		t.Errorf("unexpected result “%s” (error %v) for score of hCaptcha", reason, err)
+	}
+}
+
+func TestCaptchaFailOpen(t *testing.T) {
+	server := fakeCaptchaProvider(t)
+
+	for _, failOpen := range []bool{false, true} {
+		c := captchaConfig{
+			Provider:  captchaReCAPTCHA,
+			Secret:    "secret",
+			VerifyURL: server.URL,
+			Timeout:   time.Second,
+			FailOpen:  failOpen,
+		}
+
+		for _, token := range []string{"unavailable", "invalid-json"} {
+			reason, err := c.check(token, "192.0.2.1")
+			if reason != "" {
+				t.Errorf("unexpected reason “%s” for token “%s”", reason, token)
+			}
+
+			if failOpen && err != nil {
+				t.Errorf("unexpected error for token “%s” with fail open. Details: %s", token, err)
+			} else if !failOpen && err == nil {
+				t.Errorf("expected error for token “%s” with fail closed", token)
+			}
+		}
+
+		// the rejected tokens are never accepted
+		if reason, err := c.check("rejected", "192.0.2.1"); err != nil || !strings.HasPrefix(reason, "rejected") {
+			t.Errorf("unexpected result “%s” (error %v) for rejected token with fail open %t", reason, err, failOpen)
+		}
+	}
+}
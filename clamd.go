@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize is the size of the chunks sent with the INSTREAM command.
+const clamdChunkSize = 64 << 10
+
+// errScannerUnavailable is returned when the uploaded files can't be scanned
+// and the antivirus doesn't fail open.
+var errScannerUnavailable = errors.New("antivirus scanner unavailable")
+
+// clamdConfig stores how to reach the ClamAV daemon that scans the uploaded
+// files. The address can be a TCP address with port or an Unix socket path
+// prefixed with "unix:". When the address is empty the files aren't scanned.
+type clamdConfig struct {
+	Address  string
+	Timeout  time.Duration
+	FailOpen bool `yaml:"fail open"`
+}
+
+// scan streams the file to the daemon with the INSTREAM command, returning the
+// virus name when the file is infected.
+func (c clamdConfig) scan(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	network, address := "tcp", c.Address
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	}
+
+	conn, err := net.DialTimeout(network, address, c.Timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+
+	chunk := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, err := file.Read(chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(size); err != nil {
+				return "", err
+			}
+
+			if _, err := conn.Write(chunk[:n]); err != nil {
+				return "", err
+			}
+		}
+
+		if err == io.EOF {
+			break
+
+		} else if err != nil {
+			return "", err
+		}
+	}
+
+	// a zero length chunk ends the stream
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+
+	switch {
+	case strings.HasSuffix(reply, " OK"):
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		virus := strings.TrimSuffix(reply, " FOUND")
+		if i := strings.Index(virus, ": "); i >= 0 {
+			virus = virus[i+2:]
+		}
+		return virus, nil
+	}
+
+	return "", fmt.Errorf("unexpected antivirus reply “%s”", reply)
+}
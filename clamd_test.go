@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeClamd answers the INSTREAM commands like the ClamAV daemon, reporting
+// the files with the EICAR text as infected. The sizes of the chunks received
+// are sent in the channel.
+func fakeClamd(t *testing.T) (string, chan []int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening. Details: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	chunks := make(chan []int, 1)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			reader := bufio.NewReader(conn)
+			command, err := reader.ReadString(0)
+			if err != nil || command != "zINSTREAM\x00" {
+				conn.Close()
+				continue
+			}
+
+			var sizes []int
+			var content bytes.Buffer
+			for {
+				var size uint32
+				if err := binary.Read(reader, binary.BigEndian, &size); err != nil || size == 0 {
+					break
+				}
+				sizes = append(sizes, int(size))
+				io.CopyN(&content, reader, int64(size))
+			}
+			chunks <- sizes
+
+			if bytes.Contains(content.Bytes(), []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")) {
+				conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+			} else {
+				conn.Write([]byte("stream: OK\x00"))
+			}
+			conn.Close()
+		}
+	}()
+
+	return listener.Addr().String(), chunks
+}
+
+func TestClamdScanChunks(t *testing.T) {
+	address, chunks := fakeClamd(t)
+
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, make([]byte, 2*clamdChunkSize+10), 0600); err != nil {
+		t.Fatalf("error writing file. Details: %s", err)
+	}
+
+	c := clamdConfig{Address: address, Timeout: time.Second}
+	virus, err := c.scan(path)
+	if err != nil {
+		t.Fatalf("unexpected error scanning. Details: %s", err)
+	}
+
+	if virus != "" {
+		t.Errorf("unexpected virus “%s” in clean file", virus)
+	}
+
+	if sizes, expected := <-chunks, []int{clamdChunkSize, clamdChunkSize, 10}; !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("unexpected chunks %v (expected %v)", sizes, expected)
+	}
+}
+
+func TestClamdScanFound(t *testing.T) {
+	address, chunks := fakeClamd(t)
+
+	path := filepath.Join(t.TempDir(), "eicar")
+	eicar := `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+	if err := os.WriteFile(path, []byte(eicar), 0600); err != nil {
+		t.Fatalf("error writing file. Details: %s", err)
+	}
+
+	c := clamdConfig{Address: address, Timeout: time.Second}
+	virus, err := c.scan(path)
+	if err != nil {
+		t.Fatalf("unexpected error scanning. Details: %s", err)
+	}
+	<-chunks
+
+	if virus != "Eicar-Test-Signature" {
+		t.Errorf("unexpected virus “%s”", virus)
+	}
+}
@@ -3,20 +3,22 @@ package main
 import (
 	"bytes"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
+	"mime"
+	"mime/multipart"
 	"net"
 	"net/http"
 	"net/mail"
-	"net/smtp"
+	"net/textproto"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
-	"text/template"
 	"time"
 
 	"github.com/rafaeljusto/contactme/Godeps/_workspace/src/github.com/codegangsta/cli"
@@ -33,11 +35,42 @@ const (
 
 E-mail sent via ContactMe.
 http://github.com/rafaeljusto/contactme`
-	defaultLog              = "/var/log/contactme.log"
-	defaultRateLimitBurst   = 5.0
-	defaultRateLimitRate    = 0.00035
-	defaultRateLimitExpires = 25 * time.Hour
-	defaultRateLimitCleanup = 5 * time.Minute
+	defaultLog                     = "/var/log/contactme.log"
+	defaultRateLimitBurst          = 5.0
+	defaultRateLimitRate           = 0.00035
+	defaultRateLimitExpires        = 25 * time.Hour
+	defaultRateLimitCleanup        = 5 * time.Minute
+	defaultMailserverTimeout       = 30 * time.Second
+	defaultCircuitBreakerFailures  = 3
+	defaultCircuitBreakerTimeout   = time.Minute
+	defaultTransport               = transportSMTP
+	defaultSendmailPath            = "/usr/sbin/sendmail"
+	defaultSendmailTimeout         = 30 * time.Second
+	defaultLMTPTimeout             = 30 * time.Second
+	defaultIMAPTLS                 = imapTLSImplicit
+	defaultIMAPFolder              = "INBOX"
+	defaultIMAPTimeout             = 30 * time.Second
+	defaultCORSMaxAge              = 10 * time.Minute
+	defaultAttachmentsMaxFileSize  = 5 << 20
+	defaultAttachmentsMaxTotalSize = 10 << 20
+	defaultAttachmentsStorage      = attachmentsStorageEmail
+	defaultAttachmentsDirectory    = "/var/lib/contactme/attachments"
+	defaultAttachmentsRetention    = 7 * 24 * time.Hour
+	defaultClamdTimeout            = 30 * time.Second
+	defaultCaptchaTimeout          = 10 * time.Second
+	defaultProofOfWorkExpires      = 5 * time.Minute
+	defaultBotTokenMaxAge          = 24 * time.Hour
+	defaultBayesWeight             = 5.0
+	defaultEmailCheckTimeout       = 3 * time.Second
+	defaultEmailCheckCache         = time.Hour
+	defaultDNSBLThreshold          = 1.0
+	defaultDNSBLTimeout            = 3 * time.Second
+	defaultDNSBLCache              = time.Hour
+	defaultBayesFeedbackDirectory  = "/var/lib/contactme/feedback"
+	defaultBayesFeedbackExpires    = 30 * 24 * time.Hour
+	defaultDuplicatesMaxEntries    = 10000
+	defaultQuarantineDirectory     = "/var/lib/contactme/quarantine"
+	defaultQuarantineExpires       = 7 * 24 * time.Hour
 
 	// Possible exit codes on error
 	errOpeningConfigFile    = 1
@@ -46,49 +79,68 @@ http://github.com/rafaeljusto/contactme`
 	errParsingMailbox       = 4
 	errMissingParameters    = 5
 	errReadingEmailTemplate = 6
+	errParsingMailserver    = 7
+	errParsingTransport     = 8
+	errParsingForms         = 9
+	errGeneratingSecret     = 10
+	errLoadingClassifier    = 11
+	errPreparingQuarantine  = 12
+	errOpeningArchive       = 13
 )
 
 var (
-	ratelimit     map[string]map[string]string
-	ratelimitLock sync.RWMutex
-
 	undesiredChars = regexp.MustCompile(`(['<>])|\\"|[^\x09\x0A\x0D\x20-\x7E\xA1-\xFF]`)
 
 	config = struct {
-		Port       int
-		Mailserver struct {
-			Address  string
-			Username string
-			Password string
-		}
-		Mailbox string
-		Email   struct {
-			SubjectPrefix string `yaml:"subject prefix"`
-			Template      string
-		}
-		Log       string
-		RateLimit struct {
-			Burst   float64
-			Rate    float64
-			Expires time.Duration
-			Cleanup time.Duration
-		}
+		Port           int
+		URL            string
+		Secret         string
+		Mailserver     mailservers
+		CircuitBreaker struct {
+			Failures int
+			Timeout  time.Duration
+		} `yaml:"circuit breaker"`
+		Transport    stringList
+		Sendmail     sendmailTransport
+		LMTP         lmtpTransport
+		Maildir      maildirTransport
+		Mbox         mboxTransport
+		IMAP         imapTransport
+		Mailbox      mailbox
+		Email        emailConfig
+		Routes       []route
+		Log          string
+		RateLimit    rateLimitConfig `yaml:"rate limit"`
+		CORS         corsConfig
+		Redirect     redirectConfig
+		Fields       []field
+		BotDetection botDetectionConfig `yaml:"bot detection"`
+		Captcha      captchaConfig
+		ProofOfWork  proofOfWorkConfig `yaml:"proof of work"`
+		Duplicates   duplicatesConfig
+		Quarantine   quarantineConfig
+		Archive      archiveConfig
+		Spam         spamConfig
+		Bayes        bayesConfig
+		EmailCheck   emailCheckConfig `yaml:"email check"`
+		DNSBL        dnsblConfig
+		Attachments  attachmentsConfig
+		Clamd        clamdConfig
+		Forms        []*form
 	}{
 		Port: defaultPort,
-		Email: struct {
-			SubjectPrefix string `yaml:"subject prefix"`
-			Template      string
-		}{
+		Email: emailConfig{
 			SubjectPrefix: defaultEmailSubjectPrefix,
 			Template:      defaultEmailTemplate,
 		},
 		Log: "/var/log/contactme.log",
-		RateLimit: struct {
-			Burst   float64
-			Rate    float64
-			Expires time.Duration
-			Cleanup time.Duration
-		}{
+		EmailCheck: emailCheckConfig{
+			FailOpen: true,
+		},
+		DNSBL: dnsblConfig{
+			FailOpen: true,
+		},
+		RateLimit: rateLimitConfig{
 			Burst:   defaultRateLimitBurst,
 			Rate:    defaultRateLimitRate,
 			Expires: defaultRateLimitExpires,
@@ -96,12 +148,43 @@ var (
 		},
 	}
 
-	// Parsed template
-	emailTemplate *template.Template
+	// Forms served by the service
+	forms []*form
+
+	// Transport used to deliver the e-mails
+	deliveryTransport transport
+
+	// Key used to sign the links and tokens generated by the service
+	secret []byte
+
+	// Spam classifier trained with the feedback of the users, when enabled
+	classifier *bayesClassifier
 )
 
-func init() {
-	ratelimit = make(map[string]map[string]string)
+// emailConfig stores how the e-mail is built.
+type emailConfig struct {
+	SubjectPrefix string `yaml:"subject prefix"`
+	Template      string
+}
+
+// submission stores the normalized fields sent by the client.
+type submission struct {
+	ID       string            `json:"id"`
+	Name     string            `json:"name"`
+	Email    string            `json:"email"`
+	Subject  string            `json:"subject"`
+	Message  string            `json:"message"`
+	Language string            `json:"language"`
+	Fields   map[string]string `json:"fields"`
+
+	Attachments []attachment `json:"attachments,omitempty"`
+	Links       []attachment `json:"-"`
+
+	// Spam score, when the form checks it
+	Spam *spamResult `json:"spam,omitempty"`
+
+	// Links to train the spam classifier with the submission
+	Feedback map[string]string `json:"-"`
 }
 
 func main() {
@@ -144,19 +227,34 @@ func main() {
 		},
 	}
 
+	app.Commands = []cli.Command{
+		routeCommand,
+		trainCommand,
+	}
+
 	app.Action = func(c *cli.Context) {
 		readCommandLineInputs(c)
 		fillConfigurationDefaults()
 		validateConfiguration()
+		prepareStorage()
 
 		logFile := startLog()
 		if logFile != nil {
 			defer func() { logFile.Close() }()
 		}
+		warnOpenCORS()
 
 		go cleanup()
+		go reloadOnSignal()
 
-		http.HandleFunc("/", handle)
+		for _, f := range forms {
+			http.HandleFunc(f.Path, f.handle)
+			http.HandleFunc(tokenPath+f.ID, f.handleToken)
+			http.HandleFunc(challengePath+f.ID, f.handleChallenge)
+		}
+		http.HandleFunc(downloadPath, handleDownload)
+		http.HandleFunc(feedbackPath, handleFeedback)
+		http.HandleFunc(moderationPath, handleModeration)
 		log.Fatal(http.ListenAndServe(":"+strconv.Itoa(config.Port), nil))
 	}
 
@@ -164,7 +262,7 @@ func main() {
 }
 
 func readCommandLineInputs(c *cli.Context) {
-	if configFile := c.String("config"); configFile != "" {
+	if configFile := c.GlobalString("config"); configFile != "" {
 		data, err := ioutil.ReadFile(configFile)
 		if err != nil {
 			fmt.Printf("error opening configuration file. Details: %s\n", err)
@@ -177,7 +275,7 @@ func readCommandLineInputs(c *cli.Context) {
 		}
 	}
 
-	if port := c.String("port"); port != "" {
+	if port := c.GlobalString("port"); port != "" {
 		var err error
 		config.Port, err = strconv.Atoi(port)
 		if err != nil {
@@ -186,20 +284,25 @@ func readCommandLineInputs(c *cli.Context) {
 		}
 	}
 
-	if mailserver := c.String("mailserver"); mailserver != "" {
-		config.Mailserver.Address = mailserver
+	// command line parameters replace the primary mail server
+	if len(config.Mailserver) == 0 {
+		config.Mailserver = mailservers{{}}
+	}
+
+	if mailserver := c.GlobalString("mailserver"); mailserver != "" {
+		config.Mailserver[0].Address = mailserver
 	}
 
-	if username := c.String("username"); username != "" {
-		config.Mailserver.Username = username
+	if username := c.GlobalString("username"); username != "" {
+		config.Mailserver[0].Username = username
 	}
 
-	if password := c.String("password"); password != "" {
-		config.Mailserver.Password = password
+	if password := c.GlobalString("password"); password != "" {
+		config.Mailserver[0].Password = password
 	}
 
-	if mailbox := c.String("mailbox"); mailbox != "" {
-		config.Mailbox = mailbox
+	if address := c.GlobalString("mailbox"); address != "" {
+		config.Mailbox = mailbox{To: stringList{address}}
 	}
 }
 
@@ -208,9 +311,73 @@ func fillConfigurationDefaults() {
 		config.Port = defaultPort
 	}
 
-	config.Mailserver.Username = strings.TrimSpace(config.Mailserver.Username)
-	if config.Mailserver.Username == "" {
-		config.Mailserver.Username = config.Mailbox
+	config.URL = strings.TrimSpace(config.URL)
+
+	for i := range config.Mailserver {
+		mailserver := &config.Mailserver[i]
+
+		mailserver.Username = strings.TrimSpace(mailserver.Username)
+		if mailserver.Username == "" {
+			mailserver.Username = defaultUsername()
+		}
+
+		if mailserver.Timeout.Seconds() == 0 {
+			mailserver.Timeout = defaultMailserverTimeout
+		}
+
+		mailserver.breaker = new(circuitBreaker)
+	}
+
+	if config.CircuitBreaker.Failures == 0 {
+		config.CircuitBreaker.Failures = defaultCircuitBreakerFailures
+	}
+
+	if config.CircuitBreaker.Timeout.Seconds() == 0 {
+		config.CircuitBreaker.Timeout = defaultCircuitBreakerTimeout
+	}
+
+	var transportFilled stringList
+	for _, name := range config.Transport {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			transportFilled = append(transportFilled, name)
+		}
+	}
+	config.Transport = transportFilled
+
+	if len(config.Transport) == 0 {
+		config.Transport = stringList{defaultTransport}
+	}
+
+	config.Sendmail.Path = strings.TrimSpace(config.Sendmail.Path)
+	if config.Sendmail.Path == "" {
+		config.Sendmail.Path = defaultSendmailPath
+	}
+
+	if config.Sendmail.Timeout.Seconds() == 0 {
+		config.Sendmail.Timeout = defaultSendmailTimeout
+	}
+
+	config.LMTP.Address = strings.TrimSpace(config.LMTP.Address)
+	if config.LMTP.Timeout.Seconds() == 0 {
+		config.LMTP.Timeout = defaultLMTPTimeout
+	}
+
+	config.Maildir.Path = strings.TrimSpace(config.Maildir.Path)
+	config.Mbox.Path = strings.TrimSpace(config.Mbox.Path)
+
+	config.IMAP.Address = strings.TrimSpace(config.IMAP.Address)
+	config.IMAP.TLS = strings.ToLower(strings.TrimSpace(config.IMAP.TLS))
+	if config.IMAP.TLS == "" {
+		config.IMAP.TLS = defaultIMAPTLS
+	}
+
+	config.IMAP.Folder = strings.TrimSpace(config.IMAP.Folder)
+	if config.IMAP.Folder == "" {
+		config.IMAP.Folder = defaultIMAPFolder
+	}
+
+	if config.IMAP.Timeout.Seconds() == 0 {
+		config.IMAP.Timeout = defaultIMAPTimeout
 	}
 
 	config.Email.Template = strings.TrimSpace(config.Email.Template)
@@ -238,28 +405,288 @@ func fillConfigurationDefaults() {
 	if config.RateLimit.Cleanup.Seconds() == 0 {
 		config.RateLimit.Cleanup = defaultRateLimitCleanup
 	}
+
+	if len(config.CORS.AllowedHeaders) == 0 {
+		config.CORS.AllowedHeaders = stringList{"Content-Type", "Accept", "X-Requested-With", idempotencyKeyHeader}
+	}
+
+	if config.CORS.MaxAge.Seconds() == 0 {
+		config.CORS.MaxAge = defaultCORSMaxAge
+	}
+
+	if config.Attachments.MaxFileSize == 0 {
+		config.Attachments.MaxFileSize = defaultAttachmentsMaxFileSize
+	}
+
+	if config.Attachments.MaxTotalSize == 0 {
+		config.Attachments.MaxTotalSize = defaultAttachmentsMaxTotalSize
+	}
+
+	config.Attachments.Storage = strings.ToLower(strings.TrimSpace(config.Attachments.Storage))
+	if config.Attachments.Storage == "" {
+		config.Attachments.Storage = defaultAttachmentsStorage
+	}
+
+	config.Attachments.Directory = strings.TrimSpace(config.Attachments.Directory)
+	if config.Attachments.Directory == "" {
+		config.Attachments.Directory = defaultAttachmentsDirectory
+	}
+
+	if config.Attachments.Retention.Seconds() == 0 {
+		config.Attachments.Retention = defaultAttachmentsRetention
+	}
+
+	if config.ProofOfWork.Expires.Seconds() == 0 {
+		config.ProofOfWork.Expires = defaultProofOfWorkExpires
+	}
+
+	if config.BotDetection.MaxAge.Seconds() == 0 {
+		config.BotDetection.MaxAge = defaultBotTokenMaxAge
+	}
+
+	if config.Duplicates.MaxEntries == 0 {
+		config.Duplicates.MaxEntries = defaultDuplicatesMaxEntries
+	}
+
+	config.Quarantine.Directory = strings.TrimSpace(config.Quarantine.Directory)
+	if config.Quarantine.Directory == "" {
+		config.Quarantine.Directory = defaultQuarantineDirectory
+	}
+
+	if config.Quarantine.Expires.Seconds() == 0 {
+		config.Quarantine.Expires = defaultQuarantineExpires
+	}
+
+	if config.EmailCheck.Timeout.Seconds() == 0 {
+		config.EmailCheck.Timeout = defaultEmailCheckTimeout
+	}
+
+	if config.EmailCheck.Cache.Seconds() == 0 {
+		config.EmailCheck.Cache = defaultEmailCheckCache
+	}
+
+	var zonesFilled []dnsblZone
+	for _, zone := range config.DNSBL.Zones {
+		if zone.Zone = strings.Trim(strings.ToLower(strings.TrimSpace(zone.Zone)), "."); zone.Zone == "" {
+			continue
+		}
+
+		if zone.Weight == 0 {
+			zone.Weight = 1
+		}
+		zonesFilled = append(zonesFilled, zone)
+	}
+	config.DNSBL.Zones = zonesFilled
+
+	if config.DNSBL.Threshold == 0 {
+		config.DNSBL.Threshold = defaultDNSBLThreshold
+	}
+
+	if config.DNSBL.Timeout.Seconds() == 0 {
+		config.DNSBL.Timeout = defaultDNSBLTimeout
+	}
+
+	if config.DNSBL.Cache.Seconds() == 0 {
+		config.DNSBL.Cache = defaultDNSBLCache
+	}
+
+	config.Bayes.File = strings.TrimSpace(config.Bayes.File)
+	if config.Bayes.Weight == 0 {
+		config.Bayes.Weight = defaultBayesWeight
+	}
+
+	config.Bayes.FeedbackDirectory = strings.TrimSpace(config.Bayes.FeedbackDirectory)
+	if config.Bayes.FeedbackDirectory == "" {
+		config.Bayes.FeedbackDirectory = defaultBayesFeedbackDirectory
+	}
+
+	if config.Bayes.FeedbackExpires.Seconds() == 0 {
+		config.Bayes.FeedbackExpires = defaultBayesFeedbackExpires
+	}
+
+	config.Clamd.Address = strings.TrimSpace(config.Clamd.Address)
+	if config.Clamd.Timeout.Seconds() == 0 {
+		config.Clamd.Timeout = defaultClamdTimeout
+	}
 }
 
 func validateConfiguration() {
-	config.Mailserver.Address = strings.TrimSpace(config.Mailserver.Address)
-	config.Mailbox = strings.TrimSpace(config.Mailbox)
+	var mailserverFilled []mailserver
+	for _, mailserver := range config.Mailserver {
+		mailserver.Address = strings.TrimSpace(mailserver.Address)
+		if mailserver.Address != "" {
+			mailserverFilled = append(mailserverFilled, mailserver)
+		}
+	}
+	config.Mailserver = mailserverFilled
 
-	if config.Mailserver.Address == "" || config.Mailbox == "" {
+	if (config.Transport.contains(transportSMTP) && len(config.Mailserver) == 0) || (config.Mailbox.empty() && len(config.Forms) == 0) {
 		fmt.Println("missing “mailserver” and/or “mailbox” arguments")
 		os.Exit(errMissingParameters)
 	}
 
-	if _, err := mail.ParseAddress(config.Mailbox); err != nil {
-		fmt.Printf("invalid mailbox “%s”\n", config.Mailbox)
+	for _, mailserver := range config.Mailserver {
+		if _, _, err := net.SplitHostPort(mailserver.Address); err != nil {
+			fmt.Printf("invalid mail server address “%s”. Details: %s\n", mailserver.Address, err)
+			os.Exit(errParsingMailserver)
+		}
+
+		switch mailserver.TLS {
+		case mailserverTLSOpportunistic, mailserverTLSStartTLS, mailserverTLSImplicit, mailserverTLSNone:
+		default:
+			fmt.Printf("invalid TLS mode “%s” for mail server “%s”\n", mailserver.TLS, mailserver.Address)
+			os.Exit(errParsingMailserver)
+		}
+	}
+
+	if err := config.Mailbox.parse(); !config.Mailbox.empty() && err != nil {
+		fmt.Printf("invalid mailbox. Details: %s\n", err)
 		os.Exit(errParsingMailbox)
 	}
 
+	switch config.IMAP.TLS {
+	case imapTLSImplicit, imapTLSStartTLS, imapTLSNone:
+	default:
+		fmt.Printf("invalid TLS mode “%s” for IMAP server\n", config.IMAP.TLS)
+		os.Exit(errParsingTransport)
+	}
+
+	var deliveryTransports transports
+	for _, name := range config.Transport {
+		transport, err := newTransport(name)
+		if err != nil {
+			fmt.Printf("error setting transport. Details: %s\n", err)
+			os.Exit(errParsingTransport)
+		}
+		deliveryTransports = append(deliveryTransports, transport)
+	}
+
+	if len(deliveryTransports) == 1 {
+		deliveryTransport = deliveryTransports[0]
+	} else {
+		deliveryTransport = deliveryTransports
+	}
+
+	if err := prepareSecret(); err != nil {
+		fmt.Printf("error generating secret. Details: %s\n", err)
+		os.Exit(errGeneratingSecret)
+	}
+
+	config.EmailCheck.DisposableFile = strings.TrimSpace(config.EmailCheck.DisposableFile)
+	config.EmailCheck.Resolver = strings.TrimSpace(config.EmailCheck.Resolver)
+	if config.EmailCheck.Resolver != "" {
+		if _, _, err := net.SplitHostPort(config.EmailCheck.Resolver); err != nil {
+			fmt.Printf("invalid resolver address “%s”. Details: %s\n", config.EmailCheck.Resolver, err)
+			os.Exit(errReadingConfigFile)
+		}
+	}
+	mxResolver = newResolver(config.EmailCheck.Resolver)
+
+	config.DNSBL.Resolver = strings.TrimSpace(config.DNSBL.Resolver)
+	if config.DNSBL.Resolver != "" {
+		if _, _, err := net.SplitHostPort(config.DNSBL.Resolver); err != nil {
+			fmt.Printf("invalid resolver address “%s”. Details: %s\n", config.DNSBL.Resolver, err)
+			os.Exit(errReadingConfigFile)
+		}
+	}
+	dnsblResolver = newResolver(config.DNSBL.Resolver)
+
+	if err := loadDisposableDomains(); err != nil {
+		fmt.Printf("error reading disposable domains. Details: %s\n", err)
+		os.Exit(errReadingConfigFile)
+	}
+
+	// the classifier is only read here, as the spam rules of the forms depend
+	// on it
+	if config.Bayes.File != "" {
+		if config.URL == "" {
+			fmt.Println("missing “url” argument for the spam feedback links")
+			os.Exit(errMissingParameters)
+		}
+
+		var err error
+		if classifier, err = loadClassifier(config.Bayes.File); err != nil {
+			fmt.Printf("error loading spam classifier. Details: %s\n", err)
+			os.Exit(errLoadingClassifier)
+		}
+	}
+
+	if config.Quarantine.enabled() {
+		if config.URL == "" {
+			fmt.Println("missing “url” argument for the moderation links")
+			os.Exit(errMissingParameters)
+		}
+
+		if err := config.Quarantine.prepare(); err != nil {
+			fmt.Printf("error preparing quarantine. Details: %s\n", err)
+			os.Exit(errPreparingQuarantine)
+		}
+	}
+
+	config.Archive.File = strings.TrimSpace(config.Archive.File)
+
 	var err error
-	emailTemplate, err = template.New("ContactMe E-mail").Parse(config.Email.Template)
+	if forms, err = buildForms(); err != nil {
+		fmt.Printf("error reading forms. Details: %s\n", err)
+		os.Exit(errParsingForms)
+	}
+}
+
+// prepareStorage creates the directories and opens the files used by the
+// service. It's separated from the validation, so the commands that only read
+// the configuration (e.g. route) don't change anything on disk.
+func prepareStorage() {
+	for _, f := range forms {
+		if f.Attachments.Storage != attachmentsStorageDisk {
+			continue
+		}
+
+		if err := os.MkdirAll(f.Attachments.Directory, 0700); err != nil {
+			fmt.Printf("error creating attachments directory of form “%s”. Details: %s\n", f.ID, err)
+			os.Exit(errParsingForms)
+		}
+	}
+
+	if config.Bayes.File != "" {
+		if err := os.MkdirAll(config.Bayes.FeedbackDirectory, 0700); err != nil {
+			fmt.Printf("error creating feedback directory. Details: %s\n", err)
+			os.Exit(errLoadingClassifier)
+		}
+	}
+
+	if config.Quarantine.enabled() {
+		if err := os.MkdirAll(config.Quarantine.Directory, 0700); err != nil {
+			fmt.Printf("error creating quarantine directory. Details: %s\n", err)
+			os.Exit(errPreparingQuarantine)
+		}
+
+		if err := loadKnownSenders(); err != nil {
+			fmt.Printf("error preparing quarantine. Details: %s\n", err)
+			os.Exit(errPreparingQuarantine)
+		}
+	}
+
+	if config.Archive.File != "" {
+		var err error
+		if archiveDB, err = openArchive(config.Archive.File); err != nil {
+			fmt.Printf("error opening archive. Details: %s\n", err)
+			os.Exit(errOpeningArchive)
+		}
+	}
+}
+
+// defaultUsername returns the first mailbox address, used to authenticate in
+// the mail servers when no username is given.
+func defaultUsername() string {
+	if len(config.Mailbox.To) == 0 {
+		return ""
+	}
+
+	address, err := mail.ParseAddress(config.Mailbox.To[0])
 	if err != nil {
-		fmt.Printf("error reading e-mail template. Details: %s\n", err)
-		os.Exit(errReadingEmailTemplate)
+		return strings.TrimSpace(config.Mailbox.To[0])
 	}
+	return address.Address
 }
 
 func startLog() *os.File {
@@ -275,102 +702,425 @@ func startLog() *os.File {
 	return logFile
 }
 
-func handle(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST")
+func (f *form) handle(w http.ResponseWriter, r *http.Request) {
+	// the paths ending with a slash (like the main form "/") receive all the
+	// requests below them, so unknown paths never reach the form mailbox
+	if r.URL.Path != f.Path {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !f.handleCORS(w, r) {
+		return
+	}
 
 	if r.Method != "POST" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Header().Set("Allow", "POST, OPTIONS")
+		f.replyError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, nil)
 		return
 	}
 
 	ip, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		log.Println("invalid remote address. Details:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		f.replyError(w, r, http.StatusInternalServerError, errCodeInternal, nil)
+		return
+	}
+
+	// the identifier is generated before the checks, so the rejected requests
+	// are also found in the archive
+	id, err := newSubmissionID()
+	if err != nil {
+		log.Println("error generating submission identifier. Details:", err)
+		f.replyError(w, r, http.StatusInternalServerError, errCodeInternal, nil)
+		return
+	}
+
+	// the body of the blocked clients isn't read, so only the client data is
+	// archived
+	if zones, err := config.DNSBL.blocked(ip); err != nil {
+		log.Println("error checking DNS blocklists. Details:", err)
+		f.archive(r, ip, submission{ID: id}, archiveStatusRejected, "DNS blocklists unavailable: "+err.Error())
+		f.replyError(w, r, http.StatusServiceUnavailable, errCodeBlocklistUnavailable, nil)
+		return
+
+	} else if len(zones) > 0 {
+		log.Printf("client “%s” blocked, listed in %s", ip, strings.Join(zones, ", "))
+		f.archive(r, ip, submission{ID: id}, archiveStatusRejected, "DNS blocklists: "+strings.Join(zones, ", "))
+		f.replyError(w, r, http.StatusForbidden, errCodeIPBlocked, nil)
 		return
 	}
 
-	if granted, err := grant(ip); !granted {
-		w.WriteHeader(427)
+	input, err := f.readRequestInputs(r)
+	defer removeAttachments(input.Attachments)
+	input.ID = id
+
+	if errors.Is(err, errScannerUnavailable) {
+		log.Println("error scanning attachments. Details:", err)
+		f.archive(r, ip, input, archiveStatusRejected, "antivirus unavailable: "+err.Error())
+		f.replyError(w, r, http.StatusServiceUnavailable, errCodeScannerUnavailable, nil)
+		return
+
+	} else if err != nil {
+		log.Printf("invalid input from “%s”. Details: %s", ip, err)
+		f.archive(r, ip, input, archiveStatusRejected, "invalid input: "+err.Error())
+		fields, _ := err.(validationError)
+		f.replyInvalid(w, r, errCodeInvalidInput, fields)
+		return
+	}
+
+	// the retries and double-clicks receive the result of the original
+	// submission, that is only sent once. They are detected before the rate
+	// limit, so the retries don't spend the client quota
+	var duplicateEntry *duplicate
+	if f.Duplicates.Window > 0 {
+		var original *duplicate
+		var err error
+		keys := duplicateKeys(r.Header.Get(idempotencyKeyHeader), ip, input)
+		if duplicateEntry, original, err = f.startSubmission(keys); err == errIdempotencyKeyReused {
+			log.Printf("idempotency key from “%s” already used with another submission", ip)
+			f.archive(r, ip, input, archiveStatusRejected, "idempotency key reused")
+			f.replyError(w, r, http.StatusUnprocessableEntity, errCodeIdempotencyKeyReused, nil)
+			return
+
+		} else if original != nil {
+			log.Printf("duplicated submission from “%s”, already %s as “%s”", ip, original.status, original.id)
+			f.archive(r, ip, input, archiveStatusRejected, "duplicate of "+original.id)
+			if original.status == archiveStatusHeld {
+				f.replyHeld(w, r, original.id)
+			} else {
+				f.replySuccess(w, r, original.id)
+			}
+			return
+		}
+
+		// when the submission isn't accepted it's forgotten, so it can be
+		// retried
+		defer f.finishSubmission(duplicateEntry, "", "")
+	}
+
+	if granted, err := f.grant(ip); !granted {
+		f.archive(r, ip, input, archiveStatusRejected, "rate limited")
+		f.replyError(w, r, 427, errCodeRateLimited, nil)
 		return
 
 	} else if err != nil {
 		log.Println("error in rate limit. Details:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		f.replyError(w, r, http.StatusInternalServerError, errCodeInternal, nil)
 		return
 	}
 
-	from, subject, body, err := readRequestInputs(r)
-	if err != nil {
-		log.Printf("invalid input from “%s”. Details: %s", ip, err)
-		w.WriteHeader(http.StatusBadRequest)
+	if reason, err := checkEmail(input.Email); err != nil {
+		log.Println("error checking e-mail domain. Details:", err)
+		f.archive(r, ip, input, archiveStatusRejected, "e-mail check unavailable: "+err.Error())
+		f.replyError(w, r, http.StatusServiceUnavailable, errCodeEmailCheckUnavailable, nil)
+		return
+
+	} else if reason != "" {
+		log.Printf("e-mail “%s” from “%s” rejected: %s", input.Email, ip, reason)
+		f.archive(r, ip, input, archiveStatusRejected, "e-mail: "+reason)
+		f.replyInvalid(w, r, errCodeEmailNotAllowed, map[string]string{"email": reason})
+		return
+	}
+
+	// the bot believes that the e-mail was sent, so it doesn't try again
+	if reason := f.detectBot(r); reason != "" {
+		log.Printf("submission “%s” from “%s” discarded as bot: %s", input.ID, ip, reason)
+		f.archive(r, ip, input, archiveStatusDiscarded, "bot: "+reason)
+		f.finishSubmission(duplicateEntry, input.ID, archiveStatusDiscarded)
+		f.replySuccess(w, r, input.ID)
 		return
 	}
 
-	if err := sendEmail(from, subject, body); err != nil {
-		log.Println("error sending e-mail. Details:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	if f.Captcha.Provider != "" {
+		if reason, err := f.Captcha.check(r.FormValue(f.Captcha.Field), ip); err != nil {
+			log.Println("error verifying CAPTCHA. Details:", err)
+			f.archive(r, ip, input, archiveStatusRejected, "CAPTCHA unavailable: "+err.Error())
+			f.replyError(w, r, http.StatusServiceUnavailable, errCodeCaptchaUnavailable, nil)
+			return
+
+		} else if reason != "" {
+			log.Printf("CAPTCHA from “%s” rejected: %s", ip, reason)
+			f.archive(r, ip, input, archiveStatusRejected, "CAPTCHA: "+reason)
+			f.replyError(w, r, http.StatusBadRequest, errCodeCaptchaFailed, nil)
+			return
+		}
+	}
+
+	if f.ProofOfWork.Difficulty > 0 {
+		if reason := f.checkChallenge(ip, r.FormValue(challengeField), r.FormValue(solutionField)); reason != "" {
+			log.Printf("proof-of-work from “%s” rejected: %s", ip, reason)
+			f.archive(r, ip, input, archiveStatusRejected, "proof-of-work: "+reason)
+			f.replyError(w, r, http.StatusBadRequest, errCodeChallengeFailed, nil)
+			return
+		}
+	}
+
+	if f.Spam.enabled() {
+		input.Spam = f.Spam.evaluate(input)
+		if f.Spam.rejected(input.Spam) {
+			log.Printf("submission “%s” from “%s” rejected as spam: %s", input.ID, ip, input.Spam)
+			f.archive(r, ip, input, archiveStatusRejected, "spam: "+input.Spam.String())
+			f.replyError(w, r, http.StatusBadRequest, errCodeSpam, nil)
+			return
+		}
+	}
+
+	if reasons := config.Quarantine.reasons(input); len(reasons) > 0 {
+		if err := f.hold(input, ip, reasons); err != nil {
+			log.Println("error holding submission. Details:", err)
+			f.archive(r, ip, input, archiveStatusFailed, err.Error())
+			f.replyError(w, r, http.StatusInternalServerError, errCodeInternal, nil)
+			return
+		}
+
+		log.Printf("submission “%s” from “%s” held for moderation: %s", input.ID, ip, strings.Join(reasons, ", "))
+		f.archive(r, ip, input, archiveStatusHeld, strings.Join(reasons, ", "))
+		f.finishSubmission(duplicateEntry, input.ID, archiveStatusHeld)
+		f.replyHeld(w, r, input.ID)
+		return
+	}
+
+	// archived before sending, so a submission lost while it's sent is still
+	// found in the archive
+	f.archive(r, ip, input, archiveStatusSending, "")
+
+	// the temporary files are still removed by the deferred call above
+	if err := f.deliver(input); err != nil {
+		log.Println(err)
+		archiveStatus(input.ID, archiveStatusFailed, err.Error())
+		f.replyError(w, r, http.StatusInternalServerError, errCodeInternal, nil)
 		return
 	}
+	archiveStatus(input.ID, archiveStatusSent, "")
+
+	f.finishSubmission(duplicateEntry, input.ID, archiveStatusSent)
+	f.replySuccess(w, r, input.ID)
+}
+
+// deliver sends the e-mail of the submission, storing the attachments on disk
+// and the spam feedback when needed.
+func (f *form) deliver(input submission) error {
+	if f.Attachments.Storage == attachmentsStorageDisk && len(input.Attachments) > 0 {
+		var err error
+		if input.Links, err = f.storeAttachments(input.Attachments); err != nil {
+			return fmt.Errorf("error storing attachments. Details: %s", err)
+		}
+		input.Attachments = nil
+	}
+
+	if classifier != nil {
+		var err error
+		if input.Feedback, err = storeFeedback(input); err != nil {
+			log.Println("error storing spam feedback. Details:", err)
+		}
+	}
 
-	w.WriteHeader(http.StatusOK)
+	if err := sendEmail(f.findRoute(input), input); err != nil {
+		removeAttachments(input.Links)
+		if input.Feedback != nil {
+			removeFeedback(input.ID)
+		}
+		return fmt.Errorf("error sending e-mail. Details: %s", err)
+	}
+
+	if config.Quarantine.NewSenders {
+		addKnownSender(input.Email)
+	}
+	return nil
 }
 
-func readRequestInputs(r *http.Request) (from, subject string, body bytes.Buffer, err error) {
-	name := normalizeInput(r.FormValue("name"))
-	from = normalizeInput(r.FormValue("email"))
-	subject = normalizeInput(r.FormValue("subject"))
-	message := normalizeInput(r.FormValue("message"))
+func (f *form) readRequestInputs(r *http.Request) (input submission, err error) {
+	if err = readJSONBody(r); err != nil {
+		return
+	}
+
+	input.Fields = make(map[string]string)
+	errs := make(validationError)
+
+	if input.Attachments, err = f.readMultipartBody(r, errs); err != nil {
+		return
+	}
+
+	for _, field := range f.Fields {
+		value, message := field.validate(normalizeInput(r.FormValue(field.Name)))
+		if message != "" {
+			errs[field.Name] = message
+			continue
+		}
+		input.Fields[field.Name] = value
+	}
+
+	// fields that aren't in the form definition can still be used to route the
+	// e-mail, except the control fields
+	for field, values := range r.Form {
+		if _, ok := input.Fields[field]; ok || errs[field] != "" {
+			continue
+		}
+
+		if len(values) > 0 && !f.controlField(field) {
+			input.Fields[field] = normalizeInput(values[0])
+		}
+	}
+
+	input.Name = input.Fields["name"]
+	input.Email = input.Fields["email"]
+	input.Subject = input.Fields["subject"]
+	input.Message = input.Fields["message"]
+
+	input.Language = strings.ToLower(input.Fields["language"])
+	if input.Language == "" {
+		// use the preferred language of the browser
+		language := r.Header.Get("Accept-Language")
+		language = strings.SplitN(language, ",", 2)[0]
+		language = strings.SplitN(language, ";", 2)[0]
+		input.Language = strings.ToLower(strings.TrimSpace(language))
+	}
 
-	err = emailTemplate.Execute(&body, struct {
+	if len(errs) > 0 {
+		err = errs
+	}
+	return
+}
+
+func sendEmail(r *route, input submission) error {
+	var body bytes.Buffer
+	err := r.emailTemplate.Execute(&body, struct {
 		ClientName string
+		Email      string
+		Subject    string
 		Message    string
+		Fields     map[string]string
 	}{
-		ClientName: name,
-		Message:    message,
+		ClientName: input.Name,
+		Email:      input.Email,
+		Subject:    input.Subject,
+		Message:    input.Message,
+		Fields:     input.Fields,
 	})
 
 	if err != nil {
-		return
+		return err
 	}
 
-	_, err = mail.ParseAddress(from)
-	return
-}
+	if len(input.Links) > 0 {
+		fmt.Fprintf(&body, "\n\nAttachments (links expire on %s):\n",
+			input.Links[0].Expires.Format(time.RFC1123))
+
+		for _, link := range input.Links {
+			fmt.Fprintf(&body, "%s (%s)\n%s\n", link.Filename, byteSize(link.Size), link.URL)
+		}
+	}
+
+	if input.Feedback != nil {
+		fmt.Fprintf(&body, "\n\nMark as spam: %s\nMark as not spam: %s\n",
+			input.Feedback[bayesLabelSpam], input.Feedback[bayesLabelHam])
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	// forms without the client e-mail are sent from the mailbox itself
+	from := input.Email
+	if from == "" {
+		from = r.Mailbox.recipients()[0]
+	}
 
-func sendEmail(from, subject string, body bytes.Buffer) error {
 	header := map[string]string{
-		"From":                      from,
-		"To":                        config.Mailbox,
-		"Subject":                   config.Email.SubjectPrefix + subject,
-		"MIME-Version":              "1.0",
-		"Content-Type":              `text/plain; charset="utf-8"`,
-		"Content-Transfer-Encoding": "base64",
+		"Message-ID":   fmt.Sprintf("<%s@%s>", input.ID, hostname),
+		"From":         from,
+		"Subject":      r.Email.SubjectPrefix + input.Subject,
+		"MIME-Version": "1.0",
+	}
+
+	for key, value := range r.Mailbox.header() {
+		header[key] = value
 	}
 
-	var message string
+	if input.Spam != nil {
+		header["Subject"] = input.Spam.Tag + header["Subject"]
+		header["X-ContactMe-Spam-Score"] = input.Spam.String()
+	}
+
+	message := &emailMessage{body: body.Bytes(), attachments: input.Attachments}
+	if len(input.Attachments) == 0 {
+		header["Content-Type"] = `text/plain; charset="utf-8"`
+		header["Content-Transfer-Encoding"] = "base64"
+
+	} else {
+		// the boundary is fixed, so the message is the same every time that
+		// it's written
+		message.boundary = multipart.NewWriter(io.Discard).Boundary()
+		header["Content-Type"] = mime.FormatMediaType("multipart/mixed",
+			map[string]string{"boundary": message.boundary})
+	}
+
+	var headerContent bytes.Buffer
 	for key, value := range header {
-		message += fmt.Sprintf("%s: %s\r\n", key, value)
-	}
-	message += "\r\n" + base64.StdEncoding.EncodeToString(body.Bytes())
-
-	var auth smtp.Auth
-	if config.Mailserver.Username != "" && config.Mailserver.Password != "" {
-		auth = smtp.PlainAuth("",
-			config.Mailserver.Username,
-			config.Mailserver.Password,
-			config.Mailserver.Address[:strings.Index(config.Mailserver.Address, ":")],
-		)
-	}
-
-	return smtp.SendMail(
-		config.Mailserver.Address,
-		auth,
-		from,
-		[]string{config.Mailbox},
-		[]byte(message),
-	)
+		headerContent.WriteString(fmt.Sprintf("%s: %s\r\n", key, value))
+	}
+	headerContent.WriteString("\r\n")
+	message.header = headerContent.Bytes()
+
+	return deliveryTransport.send(from, r.Mailbox.recipients(), message)
+}
+
+// emailMessage is the e-mail written directly in the transport, so the
+// attachments are read from their temporary files while the message is sent,
+// instead of building the whole message in memory. It can be written many
+// times (e.g. failover between mail servers), always with the same content.
+type emailMessage struct {
+	header      []byte
+	body        []byte
+	attachments []attachment
+	boundary    string
+}
+
+func (m *emailMessage) WriteTo(w io.Writer) (int64, error) {
+	counter := &countingWriter{w: w}
+	if _, err := counter.Write(m.header); err != nil {
+		return counter.n, err
+	}
+
+	if len(m.attachments) == 0 {
+		encoder := base64.NewEncoder(base64.StdEncoding, &lineWrapper{w: counter})
+		if _, err := encoder.Write(m.body); err != nil {
+			return counter.n, err
+		}
+		return counter.n, encoder.Close()
+	}
+
+	writer := multipart.NewWriter(counter)
+	if err := writer.SetBoundary(m.boundary); err != nil {
+		return counter.n, err
+	}
+
+	partWriter, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {`text/plain; charset="utf-8"`},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return counter.n, err
+	}
+
+	encoder := base64.NewEncoder(base64.StdEncoding, &lineWrapper{w: partWriter})
+	if _, err := encoder.Write(m.body); err != nil {
+		return counter.n, err
+	}
+
+	if err := encoder.Close(); err != nil {
+		return counter.n, err
+	}
+
+	for _, a := range m.attachments {
+		if err := writeAttachment(writer, a); err != nil {
+			return counter.n, err
+		}
+	}
+
+	return counter.n, writer.Close()
 }
 
 func normalizeInput(input string) string {
@@ -379,10 +1129,10 @@ func normalizeInput(input string) string {
 	return input
 }
 
-func grant(ip string) (bool, error) {
-	ratelimitLock.RLock()
-	ratelimitItem := ratelimit[ip]
-	ratelimitLock.RUnlock()
+func (f *form) grant(ip string) (bool, error) {
+	f.ratelimitLock.RLock()
+	ratelimitItem := f.ratelimit[ip]
+	f.ratelimitLock.RUnlock()
 
 	now := time.Now().UTC()
 	lastEvent := now
@@ -395,7 +1145,7 @@ func grant(ip string) (bool, error) {
 		}
 	}
 
-	level := config.RateLimit.Burst
+	level := f.RateLimit.Burst
 
 	if levelString, ok := ratelimitItem["level"]; ok {
 		var err error
@@ -405,7 +1155,7 @@ func grant(ip string) (bool, error) {
 		}
 
 		diff := now.Sub(lastEvent).Seconds()
-		level = math.Min(config.RateLimit.Burst, level+diff*config.RateLimit.Rate)
+		level = math.Min(f.RateLimit.Burst, level+diff*f.RateLimit.Rate)
 	}
 
 	answer := false
@@ -419,42 +1169,159 @@ func grant(ip string) (bool, error) {
 		ratelimitItem = make(map[string]string)
 	}
 
+	if !answer {
+		ratelimitItem["throttled"] = now.UTC().Format(time.RFC3339Nano)
+	}
+
 	ratelimitItem["last"] = now.UTC().Format(time.RFC3339Nano)
 	ratelimitItem["level"] = fmt.Sprintf("%f", level)
 
-	ratelimitLock.Lock()
-	ratelimit[ip] = ratelimitItem
-	ratelimitLock.Unlock()
+	f.ratelimitLock.Lock()
+	f.ratelimit[ip] = ratelimitItem
+	f.ratelimitLock.Unlock()
 
 	return answer, nil
 }
 
+// throttled checks if the rate limit denied e-mails from the IP recently.
+func (f *form) throttled(ip string) bool {
+	f.ratelimitLock.RLock()
+	throttled, ok := f.ratelimit[ip]["throttled"]
+	f.ratelimitLock.RUnlock()
+
+	if !ok {
+		return false
+	}
+
+	throttledEvent, err := time.Parse(time.RFC3339Nano, throttled)
+	return err == nil && time.Since(throttledEvent) <= f.RateLimit.Expires
+}
+
 func cleanup() {
 	for {
-		newRatelimit := make(map[string]map[string]string)
-		now := time.Now()
-
-		ratelimitLock.Lock()
-		for ip, ratelimitItem := range ratelimit {
-			last, ok := ratelimitItem["last"]
-			if !ok {
-				newRatelimit[ip] = ratelimitItem
-				continue
-			}
+		for _, f := range forms {
+			f.cleanup()
+			f.cleanupChallenges()
+			f.cleanupDuplicates()
+			f.removeExpiredAttachments()
+		}
+		removeExpiredFeedback()
+		removeExpiredQuarantine()
+		mxCache.cleanup()
+		dnsblCache.cleanup()
 
-			lastEvent, err := time.Parse(time.RFC3339Nano, last)
-			if err != nil {
-				newRatelimit[ip] = ratelimitItem
-				continue
-			}
+		time.Sleep(config.RateLimit.Cleanup)
+	}
+}
 
-			if now.Sub(lastEvent) <= config.RateLimit.Expires {
-				newRatelimit[ip] = ratelimitItem
-			}
+func (f *form) cleanup() {
+	newRatelimit := make(map[string]map[string]string)
+	now := time.Now()
+
+	f.ratelimitLock.Lock()
+	defer f.ratelimitLock.Unlock()
+
+	for ip, ratelimitItem := range f.ratelimit {
+		last, ok := ratelimitItem["last"]
+		if !ok {
+			newRatelimit[ip] = ratelimitItem
+			continue
 		}
-		ratelimit = newRatelimit
-		ratelimitLock.Unlock()
 
-		time.Sleep(config.RateLimit.Cleanup)
+		lastEvent, err := time.Parse(time.RFC3339Nano, last)
+		if err != nil {
+			newRatelimit[ip] = ratelimitItem
+			continue
+		}
+
+		if now.Sub(lastEvent) <= f.RateLimit.Expires {
+			newRatelimit[ip] = ratelimitItem
+		}
+	}
+	f.ratelimit = newRatelimit
+}
+
+// stringList is a list of strings that in the configuration file can also be
+// written as a single string.
+type stringList []string
+
+func (s *stringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*s = list
+		return nil
+	}
+
+	var single string
+	if err := unmarshal(&single); err != nil {
+		return err
+	}
+
+	*s = stringList{single}
+	return nil
+}
+
+func (s stringList) contains(value string) bool {
+	for _, item := range s {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// byteSize is a size in bytes that in the configuration file can also be
+// written with an unit (e.g. 512KB, 5MB or 1GB).
+type byteSize int64
+
+func (b *byteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var size int64
+	if err := unmarshal(&size); err == nil {
+		*b = byteSize(size)
+		return nil
+	}
+
+	var text string
+	if err := unmarshal(&text); err != nil {
+		return err
+	}
+
+	text = strings.ToUpper(strings.TrimSpace(text))
+	multiplier := int64(1)
+
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(text, unit.suffix) {
+			text = strings.TrimSpace(strings.TrimSuffix(text, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	size, err := strconv.ParseInt(text, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size “%s”", text)
+	}
+
+	*b = byteSize(size * multiplier)
+	return nil
+}
+
+func (b byteSize) String() string {
+	switch {
+	case b >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(b)/(1<<30))
+	case b >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(b)/(1<<20))
+	case b >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(b)/(1<<10))
 	}
+	return fmt.Sprintf("%d B", int64(b))
 }
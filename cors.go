@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsConfig stores which web sites can send requests to a form using the
+// browser (Cross-Origin Resource Sharing).
+type corsConfig struct {
+	AllowedOrigins stringList    `yaml:"allowed origins"`
+	AllowedHeaders stringList    `yaml:"allowed headers"`
+	MaxAge         time.Duration `yaml:"max age"`
+}
+
+// allowed checks if the origin is in the allowlist. The allowlist accepts
+// exact origins (e.g. https://example.com) or wildcards for the subdomains
+// (e.g. https://*.example.com). An empty allowlist accepts any origin.
+func (c corsConfig) allowed(origin string) bool {
+	if c.allowAll() {
+		return true
+	}
+
+	origin = strings.ToLower(origin)
+
+	for _, pattern := range c.AllowedOrigins {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "/"))
+
+		wildcard := strings.Index(pattern, "*.")
+		if wildcard == -1 {
+			if origin == pattern {
+				return true
+			}
+			continue
+		}
+
+		prefix, suffix := pattern[:wildcard], pattern[wildcard+1:]
+		if !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+			continue
+		}
+
+		subdomain := strings.TrimSuffix(strings.TrimPrefix(origin, prefix), suffix)
+		if subdomain != "" && !strings.ContainsAny(subdomain, "/:") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c corsConfig) allowAll() bool {
+	return len(c.AllowedOrigins) == 0 || c.AllowedOrigins.contains("*")
+}
+
+// warnOpenCORS logs the forms that accept requests from any web site only
+// because their allowlist is empty, as it's probably a forgotten setting.
+func warnOpenCORS() {
+	for _, f := range forms {
+		if len(f.CORS.AllowedOrigins) == 0 {
+			log.Printf("warning: form “%s” accepts requests from any web site, "+
+				"as its CORS allowed origins are empty", f.ID)
+		}
+	}
+}
+
+// handleCORS sets the CORS headers of the response, rejecting the requests of
+// origins that aren't allowed and answering the preflight requests. It returns
+// false when the request was already answered.
+func (f *form) handleCORS(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Add("Vary", "Origin")
+
+	origin := r.Header.Get("Origin")
+	if origin != "" {
+		if !f.CORS.allowed(origin) {
+			log.Printf("origin “%s” not allowed in form “%s”", origin, f.ID)
+			f.replyError(w, r, http.StatusForbidden, errCodeOriginNotAllowed, nil)
+			return false
+		}
+
+		if f.CORS.allowAll() {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+	}
+
+	if r.Method != "OPTIONS" {
+		return true
+	}
+
+	w.Header().Set("Allow", "POST, OPTIONS")
+
+	if origin != "" && r.Header.Get("Access-Control-Request-Method") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(f.CORS.AllowedHeaders, ", "))
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(f.CORS.MaxAge.Seconds())))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return false
+}
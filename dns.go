@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// newResolver creates a resolver that sends the queries to the address (host
+// and port). When the address is empty the resolver of the system is used.
+func newResolver(address string) *net.Resolver {
+	if address == "" {
+		return net.DefaultResolver
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// dnsNotFound checks if the DNS answered that the name or the record doesn't
+// exist, instead of failing to answer.
+func dnsNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// dnsCache stores the results of the DNS checks for a while, so the same
+// queries aren't repeated for every submission.
+type dnsCache struct {
+	sync.Mutex
+	entries map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	result  bool
+	expires time.Time
+}
+
+// get returns the cached result, if it didn't expire yet.
+func (d *dnsCache) get(key string) (result bool, found bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	entry, ok := d.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return false, false
+	}
+	return entry.result, true
+}
+
+func (d *dnsCache) set(key string, result bool, ttl time.Duration) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.entries == nil {
+		d.entries = make(map[string]dnsCacheEntry)
+	}
+	d.entries[key] = dnsCacheEntry{result: result, expires: time.Now().Add(ttl)}
+}
+
+// cleanup removes the expired results.
+func (d *dnsCache) cleanup() {
+	now := time.Now()
+
+	d.Lock()
+	defer d.Unlock()
+
+	for key, entry := range d.entries {
+		if now.After(entry.expires) {
+			delete(d.entries, key)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// DNS record types used by the fake server
+const (
+	dnsTypeA    = 1
+	dnsTypeMX   = 15
+	dnsTypeAAAA = 28
+)
+
+// fakeDNSRecord is an answer of the fake DNS server, with the data already
+// encoded.
+type fakeDNSRecord struct {
+	qtype uint16
+	data  []byte
+}
+
+func dnsA(address string) fakeDNSRecord {
+	return fakeDNSRecord{qtype: dnsTypeA, data: net.ParseIP(address).To4()}
+}
+
+func dnsMX(preference uint16, host string) fakeDNSRecord {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, preference)
+	return fakeDNSRecord{qtype: dnsTypeMX, data: append(data, dnsName(host)...)}
+}
+
+// dnsName encodes the domain name in labels, without compression.
+func dnsName(name string) []byte {
+	var data []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label != "" {
+			data = append(data, byte(len(label)))
+			data = append(data, label...)
+		}
+	}
+	return append(data, 0)
+}
+
+// fakeDNS is an authoritative DNS server that answers with the records of
+// the names (with the final dot). Unknown names are answered with NXDOMAIN,
+// and the names queried are stored.
+type fakeDNS struct {
+	records map[string][]fakeDNSRecord
+
+	lock    sync.Mutex
+	queries []string
+}
+
+func newFakeDNS(t *testing.T, records map[string][]fakeDNSRecord) (*fakeDNS, string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening. Details: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	server := &fakeDNS{records: records}
+
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, address, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+
+			if response := server.answer(buffer[:n]); response != nil {
+				conn.WriteTo(response, address)
+			}
+		}
+	}()
+
+	return server, conn.LocalAddr().String()
+}
+
+// answer builds the response of the query, copying the question.
+func (f *fakeDNS) answer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+
+	// question name, type and class
+	var labels []string
+	offset := 12
+	for offset < len(query) && query[offset] != 0 {
+		size := int(query[offset])
+		if offset+1+size > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[offset+1:offset+1+size]))
+		offset += 1 + size
+	}
+
+	if offset+5 > len(query) {
+		return nil
+	}
+	question := query[12 : offset+5]
+	qtype := binary.BigEndian.Uint16(query[offset+1:])
+	name := strings.ToLower(strings.Join(labels, ".")) + "."
+
+	f.lock.Lock()
+	f.queries = append(f.queries, name)
+	f.lock.Unlock()
+
+	records, found := f.records[name]
+
+	var answers []byte
+	count := 0
+	for _, record := range records {
+		if record.qtype != qtype {
+			continue
+		}
+
+		answer := make([]byte, 12)
+		binary.BigEndian.PutUint16(answer[0:], 0xc00c) // pointer to the question
+		binary.BigEndian.PutUint16(answer[2:], record.qtype)
+		binary.BigEndian.PutUint16(answer[4:], 1) // IN
+		binary.BigEndian.PutUint32(answer[6:], 60)
+		binary.BigEndian.PutUint16(answer[10:], uint16(len(record.data)))
+		answers = append(append(answers, answer...), record.data...)
+		count++
+	}
+
+	// response, authoritative, recursion desired and available
+	flags := uint16(0x8580)
+	if !found {
+		flags |= 3 // NXDOMAIN
+	}
+
+	header := make([]byte, 12)
+	copy(header, query[:2])
+	binary.BigEndian.PutUint16(header[2:], flags)
+	binary.BigEndian.PutUint16(header[4:], 1)
+	binary.BigEndian.PutUint16(header[6:], uint16(count))
+
+	response := append(header, question...)
+	return append(response, answers...)
+}
+
+// queried checks if the name was queried.
+func (f *fakeDNS) queried(name string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, query := range f.queries {
+		if query == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReceivesEmail(t *testing.T) {
+	_, address := newFakeDNS(t, map[string][]fakeDNSRecord{
+		"mx.example.":      {dnsMX(10, "mail.mx.example.")},
+		"null-mx.example.": {dnsMX(0, ".")},
+		"a.example.":       {dnsA("192.0.2.1")},
+		"empty.example.":   nil,
+	})
+
+	originalResolver, originalConfig := mxResolver, config.EmailCheck
+	t.Cleanup(func() {
+		mxResolver, config.EmailCheck = originalResolver, originalConfig
+		mxCache = dnsCache{}
+	})
+
+	mxResolver = newResolver(address)
+	config.EmailCheck.Timeout = time.Second
+	config.EmailCheck.Cache = time.Minute
+	mxCache = dnsCache{}
+
+	scenarios := []struct {
+		domain   string
+		expected bool
+	}{
+		{domain: "mx.example", expected: true},
+		{domain: "null-mx.example", expected: false},
+		{domain: "a.example", expected: true},
+		{domain: "empty.example", expected: false},
+		{domain: "unknown.example", expected: false},
+	}
+
+	for _, scenario := range scenarios {
+		receives, err := receivesEmail(scenario.domain)
+		if err != nil {
+			t.Errorf("unexpected error checking “%s”. Details: %s", scenario.domain, err)
+			continue
+		}
+
+		if receives != scenario.expected {
+			t.Errorf("unexpected result for “%s”: %t (expected %t)", scenario.domain, receives, scenario.expected)
+		}
+	}
+}
+
+func TestReceivesEmailUnavailable(t *testing.T) {
+	// nothing answers in this address, so the query times out
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening. Details: %s", err)
+	}
+	defer conn.Close()
+
+	originalResolver, originalConfig := mxResolver, config.EmailCheck
+	t.Cleanup(func() {
+		mxResolver, config.EmailCheck = originalResolver, originalConfig
+		mxCache = dnsCache{}
+	})
+
+	mxResolver = newResolver(conn.LocalAddr().String())
+	config.EmailCheck.Timeout = 200 * time.Millisecond
+	mxCache = dnsCache{}
+
+	if _, err := receivesEmail("mx.example"); err == nil {
+		t.Error("expected an error when the DNS doesn't answer")
+	}
+}
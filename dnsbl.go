@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dnsblConfig stores the DNS blocklists where the client IP is checked. The
+// client is blocked when the sum of the weights of the lists where the IP is
+// listed reaches the threshold.
+type dnsblConfig struct {
+	Zones     []dnsblZone
+	Threshold float64
+	Resolver  string
+	Timeout   time.Duration
+	Cache     time.Duration
+	FailOpen  bool `yaml:"fail open"`
+}
+
+type dnsblZone struct {
+	Zone   string
+	Weight float64
+}
+
+var (
+	// dnsblResolver is the resolver used to query the blocklists.
+	dnsblResolver *net.Resolver
+
+	// dnsblCache stores if the IP is listed in each zone.
+	dnsblCache dnsCache
+)
+
+// dnsblQuery builds the name queried in the zone for the IP: the IPv4 octets
+// or the IPv6 nibbles in reverse order.
+func dnsblQuery(ip net.IP, zone string) string {
+	var labels []string
+	if ipv4 := ip.To4(); ipv4 != nil {
+		for i := len(ipv4) - 1; i >= 0; i-- {
+			labels = append(labels, strconv.Itoa(int(ipv4[i])))
+		}
+
+	} else {
+		ipv6 := ip.To16()
+		for i := len(ipv6) - 1; i >= 0; i-- {
+			labels = append(labels, strconv.FormatInt(int64(ipv6[i]&0x0f), 16),
+				strconv.FormatInt(int64(ipv6[i]>>4), 16))
+		}
+	}
+
+	return strings.Join(labels, ".") + "." + zone + "."
+}
+
+// listed checks if the IP is in the zone. The lists answer with an address
+// in 127.0.0.0/8, and 127.255.255.0/24 is used by some lists to report
+// errors (e.g. queries from public resolvers), so it doesn't count.
+func (d dnsblConfig) listed(ip net.IP, zone string) (bool, error) {
+	key := zone + " " + ip.String()
+	if result, found := dnsblCache.get(key); found {
+		return result, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout)
+	defer cancel()
+
+	addresses, err := dnsblResolver.LookupIPAddr(ctx, dnsblQuery(ip, zone))
+	if err != nil && !dnsNotFound(err) {
+		return false, err
+	}
+
+	result := false
+	for _, address := range addresses {
+		ipv4 := address.IP.To4()
+		if ipv4 != nil && ipv4[0] == 127 && !(ipv4[1] == 255 && ipv4[2] == 255) {
+			result = true
+			break
+		}
+	}
+
+	dnsblCache.set(key, result, d.Cache)
+	return result, nil
+}
+
+// blocked queries all the zones at the same time, returning the zones where
+// the IP is listed when their weights reach the threshold. An error is only
+// returned when a zone couldn't be checked and the check doesn't fail open.
+func (d dnsblConfig) blocked(address string) ([]string, error) {
+	ip := net.ParseIP(address)
+	if ip == nil || len(d.Zones) == 0 {
+		return nil, nil
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var zones []string
+	var score float64
+	var lastErr error
+
+	for _, zone := range d.Zones {
+		wg.Add(1)
+		go func(zone dnsblZone) {
+			defer wg.Done()
+
+			listed, err := d.listed(ip, zone.Zone)
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			if err != nil {
+				lastErr = fmt.Errorf("zone “%s”. Details: %s", zone.Zone, err)
+				return
+			}
+
+			if listed {
+				zones = append(zones, zone.Zone)
+				score += zone.Weight
+			}
+		}(zone)
+	}
+	wg.Wait()
+
+	if score >= d.Threshold {
+		return zones, nil
+	}
+
+	if lastErr != nil {
+		if d.FailOpen {
+			log.Printf("error checking IP “%s” in the DNS blocklists, ignoring it. Details: %s", address, lastErr)
+			return nil, nil
+		}
+		return nil, lastErr
+	}
+
+	return nil, nil
+}
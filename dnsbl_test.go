@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDNSBLBlocked(t *testing.T) {
+	ipv6Query := "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.bl.example."
+
+	server, address := newFakeDNS(t, map[string][]fakeDNSRecord{
+		ipv6Query:                 {dnsA("127.0.0.2")},
+		"2.2.0.192.bl.example.":   {dnsA("127.0.0.4")},
+		"3.2.0.192.bl.example.":   {dnsA("127.255.255.254")},
+		"2.2.0.192.weak.example.": {dnsA("127.0.0.2")},
+		"1.2.0.192.weak.example.": {dnsA("127.0.0.2")},
+		"4.2.0.192.bl.example.":   nil,
+	})
+
+	originalResolver := dnsblResolver
+	t.Cleanup(func() {
+		dnsblResolver = originalResolver
+		dnsblCache = dnsCache{}
+	})
+
+	dnsblResolver = newResolver(address)
+	dnsblCache = dnsCache{}
+
+	d := dnsblConfig{
+		Zones: []dnsblZone{
+			{Zone: "bl.example", Weight: 1.0},
+			{Zone: "weak.example", Weight: 0.5},
+		},
+		Threshold: 1.0,
+		Timeout:   time.Second,
+		Cache:     time.Minute,
+	}
+
+	scenarios := []struct {
+		ip       string
+		expected []string
+	}{
+		{ip: "2001:db8::1", expected: []string{"bl.example"}},
+		{ip: "192.0.2.1", expected: nil},
+		{ip: "192.0.2.3", expected: nil},
+		{ip: "192.0.2.4", expected: nil},
+	}
+
+	for _, scenario := range scenarios {
+		zones, err := d.blocked(scenario.ip)
+		if err != nil {
+			t.Errorf("unexpected error checking “%s”. Details: %s", scenario.ip, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(zones, scenario.expected) {
+			t.Errorf("unexpected zones for “%s”: %v (expected %v)", scenario.ip, zones, scenario.expected)
+		}
+	}
+
+	// listed in both zones, in any order
+	if zones, err := d.blocked("192.0.2.2"); err != nil || len(zones) != 2 {
+		t.Errorf("unexpected zones for “192.0.2.2”: %v (error %v)", zones, err)
+	}
+
+	if !server.queried(ipv6Query) {
+		t.Errorf("IPv6 address not queried with the reversed nibbles “%s”", ipv6Query)
+	}
+}
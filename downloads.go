@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// downloadPath is where the attachments stored on disk are served.
+const downloadPath = "/download/"
+
+// Where the uploaded files go
+const (
+	attachmentsStorageEmail = "email"
+	attachmentsStorageDisk  = "disk"
+)
+
+var downloadTokenFormat = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// storeAttachments copies the uploaded files to the attachments directory,
+// returning them with the signed download links. The links expire together
+// with the files.
+func (f *form) storeAttachments(attachments []attachment) ([]attachment, error) {
+	var stored []attachment
+	expires := time.Now().Add(f.Attachments.Retention)
+
+	for _, a := range attachments {
+		token := make([]byte, 16)
+		if _, err := rand.Read(token); err != nil {
+			removeAttachments(stored)
+			return nil, err
+		}
+		a.Token = hex.EncodeToString(token)
+
+		if err := copyFile(a.Path, filepath.Join(f.Attachments.Directory, a.Token)); err != nil {
+			removeAttachments(stored)
+			return nil, err
+		}
+
+		a.Path = filepath.Join(f.Attachments.Directory, a.Token)
+		a.Expires = expires
+		a.URL = f.downloadURL(a)
+		stored = append(stored, a)
+	}
+
+	return stored, nil
+}
+
+// downloadURL builds the signed link of the stored attachment.
+func (f *form) downloadURL(a attachment) string {
+	expires := strconv.FormatInt(a.Expires.Unix(), 10)
+
+	query := make(url.Values)
+	query.Set("expires", expires)
+	query.Set("signature", sign("download", f.ID, a.Token, a.Filename, expires))
+
+	return strings.TrimRight(config.URL, "/") + downloadPath +
+		url.PathEscape(f.ID) + "/" + a.Token + "/" + url.PathEscape(a.Filename) +
+		"?" + query.Encode()
+}
+
+// handleDownload serves the attachments stored on disk. The path has the form
+// identifier, the file token and the file name, and the signature in the query
+// string proves that the link was generated by the service.
+func handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, downloadPath), "/", 3)
+	if len(parts) != 3 || !downloadTokenFormat.MatchString(parts[1]) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	formID, token, filename := parts[0], parts[1], parts[2]
+
+	f := findForm(formID)
+	if f == nil || formID == "" || f.Attachments.Storage != attachmentsStorageDisk {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	expires := r.URL.Query().Get("expires")
+	if !validSignature(r.URL.Query().Get("signature"), "download", formID, token, filename, expires) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if expiresAt, err := strconv.ParseInt(expires, 10, 64); err != nil || time.Now().Unix() > expiresAt {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	file, err := os.Open(filepath.Join(f.Attachments.Directory, token))
+	if os.IsNotExist(err) {
+		w.WriteHeader(http.StatusGone)
+		return
+
+	} else if err != nil {
+		log.Printf("error opening attachment “%s”. Details: %s", token, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		log.Printf("error reading attachment “%s”. Details: %s", token, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// the file is always downloaded, so a malicious upload can't run in the
+	// browser with the service origin
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private")
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
+
+// removeExpiredAttachments removes the stored files older than the retention
+// period.
+func (f *form) removeExpiredAttachments() {
+	if f.Attachments.Storage != attachmentsStorageDisk {
+		return
+	}
+
+	entries, err := os.ReadDir(f.Attachments.Directory)
+	if err != nil {
+		log.Printf("error reading attachments directory “%s”. Details: %s", f.Attachments.Directory, err)
+		return
+	}
+
+	for _, entry := range entries {
+		if !downloadTokenFormat.MatchString(entry.Name()) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) <= f.Attachments.Retention {
+			continue
+		}
+
+		path := filepath.Join(f.Attachments.Directory, entry.Name())
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("error removing attachment “%s”. Details: %s", path, err)
+		}
+	}
+}
+
+// copyFile copies the file content to a new file, only readable by the
+// service.
+func copyFile(from, to string) error {
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(target, source); err != nil {
+		target.Close()
+		os.Remove(to)
+		return err
+	}
+
+	if err := target.Close(); err != nil {
+		os.Remove(to)
+		return fmt.Errorf("error writing “%s”. Details: %s", to, err)
+	}
+	return nil
+}
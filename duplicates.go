@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// idempotencyKeyHeader is the header where the clients send a unique key for
+// each submission, so the retries aren't sent again.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeySize avoids storing huge keys sent by the clients.
+const maxIdempotencyKeySize = 255
+
+// errIdempotencyKeyReused is returned when the client sends an idempotency key
+// that was already used with a different content.
+var errIdempotencyKeyReused = errors.New("idempotency key already used with another submission")
+
+// duplicatesConfig stores how long the submissions are remembered to detect
+// the duplicated ones, with the same idempotency key or the same content. When
+// the window is zero the duplicates aren't detected.
+type duplicatesConfig struct {
+	Window     time.Duration
+	MaxEntries int `yaml:"max entries"`
+}
+
+// duplicate is a submission remembered by the form. While the submission is
+// in progress the done channel is open, and the other requests for the same
+// submission wait for the result. The status is the outcome of the original
+// submission (sent, held or discarded), replayed to the duplicates. The
+// content is the key with the hash of the submission, used to detect the
+// idempotency keys reused with other content.
+type duplicate struct {
+	id      string
+	status  string
+	content string
+	done    chan struct{}
+	expires time.Time
+}
+
+// duplicateKeys returns the keys that identify the submission: the
+// idempotency key sent by the client, scoped by the client IP, and the hash
+// of the sender, subject and message, that is always the last key. Without
+// the e-mail address the client IP identifies the sender.
+func duplicateKeys(idempotencyKey, ip string, input submission) []string {
+	var keys []string
+
+	if idempotencyKey = strings.TrimSpace(idempotencyKey); idempotencyKey != "" && len(idempotencyKey) <= maxIdempotencyKeySize {
+		keys = append(keys, "key:"+ip+"\x00"+idempotencyKey)
+	}
+
+	sender := strings.ToLower(input.Email)
+	if sender == "" {
+		sender = ip
+	}
+
+	hash := sha256.Sum256([]byte(sender + "\x00" + input.Subject + "\x00" + input.Message))
+	keys = append(keys, "content:"+hex.EncodeToString(hash[:]))
+	return keys
+}
+
+// startSubmission remembers the submission, returning the original submission
+// when it's a duplicate. When the original submission is still in progress it
+// waits for the result, and when the original failed the submission is
+// processed again. When the idempotency key was already used with a different
+// content errIdempotencyKeyReused is returned. The returned entry must be
+// finished.
+func (f *form) startSubmission(keys []string) (entry, original *duplicate, err error) {
+	content := keys[len(keys)-1]
+
+	for {
+		f.duplicatesLock.Lock()
+
+		original = nil
+		for _, key := range keys {
+			if d, ok := f.duplicates[key]; ok && (d.expires.IsZero() || time.Now().Before(d.expires)) {
+				original = d
+				break
+			}
+		}
+
+		if original != nil && original.content != content {
+			f.duplicatesLock.Unlock()
+			return nil, original, errIdempotencyKeyReused
+		}
+
+		if original == nil {
+			entry = &duplicate{content: content, done: make(chan struct{})}
+			if len(f.duplicates)+len(keys) > f.Duplicates.MaxEntries {
+				f.evictDuplicates(len(keys))
+			}
+			for _, key := range keys {
+				f.duplicates[key] = entry
+			}
+			f.duplicatesLock.Unlock()
+			return entry, nil, nil
+		}
+
+		f.duplicatesLock.Unlock()
+		<-original.done
+
+		if original.status != "" {
+			return nil, original, nil
+		}
+	}
+}
+
+// finishSubmission stores the outcome of the submission. Only the submissions
+// that were accepted (with a status) are remembered, so the clients can retry
+// after a failure.
+func (f *form) finishSubmission(entry *duplicate, id, status string) {
+	if entry == nil {
+		return
+	}
+
+	f.duplicatesLock.Lock()
+	defer f.duplicatesLock.Unlock()
+
+	select {
+	case <-entry.done:
+		// already finished
+		return
+	default:
+	}
+
+	entry.id = id
+	entry.status = status
+	entry.expires = time.Now().Add(f.Duplicates.Window)
+
+	if status == "" {
+		for key, d := range f.duplicates {
+			if d == entry {
+				delete(f.duplicates, key)
+			}
+		}
+	}
+
+	close(entry.done)
+}
+
+// evictDuplicates removes the expired submissions and, when it's still not
+// enough, the ones that expire first, so the memory used is limited. The
+// submissions in progress are kept. It must be called with the lock held.
+func (f *form) evictDuplicates(needed int) {
+	now := time.Now()
+	for key, d := range f.duplicates {
+		if !d.expires.IsZero() && now.After(d.expires) {
+			delete(f.duplicates, key)
+		}
+	}
+
+	for len(f.duplicates)+needed > f.Duplicates.MaxEntries {
+		var oldestKey string
+		var oldest *duplicate
+		for key, d := range f.duplicates {
+			if !d.expires.IsZero() && (oldest == nil || d.expires.Before(oldest.expires)) {
+				oldestKey, oldest = key, d
+			}
+		}
+
+		if oldest == nil {
+			return
+		}
+		delete(f.duplicates, oldestKey)
+	}
+}
+
+// cleanupDuplicates forgets the submissions that are out of the window.
+func (f *form) cleanupDuplicates() {
+	now := time.Now()
+
+	f.duplicatesLock.Lock()
+	defer f.duplicatesLock.Unlock()
+
+	for key, d := range f.duplicates {
+		if !d.expires.IsZero() && now.After(d.expires) {
+			delete(f.duplicates, key)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDuplicatesReplayOutcome(t *testing.T) {
+	f := &form{
+		Duplicates: duplicatesConfig{Window: time.Minute, MaxEntries: 10},
+		duplicates: make(map[string]*duplicate),
+	}
+
+	keys := duplicateKeys("", "192.0.2.1", submission{
+		Email:   "john@example.com",
+		Subject: "Quote",
+		Message: "Hello",
+	})
+
+	entry, original, _ := f.startSubmission(keys)
+	if original != nil {
+		t.Fatalf("unexpected original submission “%s”", original.id)
+	}
+	f.finishSubmission(entry, "abc", archiveStatusHeld)
+
+	entry, original, _ = f.startSubmission(keys)
+	if entry != nil || original == nil {
+		t.Fatal("duplicated submission not detected")
+	}
+
+	if original.id != "abc" || original.status != archiveStatusHeld {
+		t.Errorf("unexpected outcome replayed: “%s” %s", original.id, original.status)
+	}
+}
+
+func TestDuplicatesForgetFailures(t *testing.T) {
+	f := &form{
+		Duplicates: duplicatesConfig{Window: time.Minute, MaxEntries: 10},
+		duplicates: make(map[string]*duplicate),
+	}
+
+	keys := duplicateKeys("key", "192.0.2.1", submission{Message: "Hello"})
+
+	entry, _, _ := f.startSubmission(keys)
+	f.finishSubmission(entry, "", "")
+
+	if entry, original, _ := f.startSubmission(keys); entry == nil || original != nil {
+		t.Error("failed submission was remembered")
+	}
+}
+
+func TestDuplicatesIdempotencyKey(t *testing.T) {
+	f := &form{
+		Duplicates: duplicatesConfig{Window: time.Minute, MaxEntries: 10},
+		duplicates: make(map[string]*duplicate),
+	}
+
+	input := submission{Email: "john@example.com", Subject: "Quote", Message: "Hello"}
+	entry, _, _ := f.startSubmission(duplicateKeys("key", "192.0.2.1", input))
+	f.finishSubmission(entry, "abc", archiveStatusSent)
+
+	// the same key from another client is a different submission
+	other := submission{Email: "jane@example.com", Subject: "Quote", Message: "Hi"}
+	entry, original, err := f.startSubmission(duplicateKeys("key", "192.0.2.2", other))
+	if err != nil || entry == nil || original != nil {
+		t.Errorf("idempotency key not scoped by the client IP (error %v)", err)
+	}
+
+	// the same key and client with another content is rejected
+	changed := submission{Email: "john@example.com", Subject: "Quote", Message: "Hello again"}
+	entry, _, err = f.startSubmission(duplicateKeys("key", "192.0.2.1", changed))
+	if err != errIdempotencyKeyReused || entry != nil {
+		t.Errorf("unexpected result for reused idempotency key (error %v)", err)
+	}
+
+	// the same key and content is replayed
+	_, original, err = f.startSubmission(duplicateKeys("key", "192.0.2.1", input))
+	if err != nil || original == nil || original.id != "abc" {
+		t.Errorf("duplicated submission not replayed (error %v)", err)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// bundledDisposableDomains are well known disposable mailbox services, always
+// rejected when the disposable check is enabled.
+var bundledDisposableDomains = []string{
+	"10minutemail.com",
+	"20minutemail.com",
+	"33mail.com",
+	"burnermail.io",
+	"discard.email",
+	"dispostable.com",
+	"emailondeck.com",
+	"fakeinbox.com",
+	"getairmail.com",
+	"getnada.com",
+	"guerrillamail.biz",
+	"guerrillamail.com",
+	"guerrillamail.de",
+	"guerrillamail.info",
+	"guerrillamail.net",
+	"guerrillamail.org",
+	"guerrillamailblock.com",
+	"harakirimail.com",
+	"incognitomail.org",
+	"mailcatch.com",
+	"maildrop.cc",
+	"mailinator.com",
+	"mailinator.net",
+	"mailnesia.com",
+	"mintemail.com",
+	"mohmal.com",
+	"mytemp.email",
+	"sharklasers.com",
+	"spam4.me",
+	"spamgourmet.com",
+	"temp-mail.org",
+	"tempail.com",
+	"tempmail.net",
+	"tempmailo.com",
+	"tempr.email",
+	"throwawaymail.com",
+	"trashmail.com",
+	"trashmail.de",
+	"trashmail.net",
+	"yopmail.com",
+	"yopmail.fr",
+	"yopmail.net",
+}
+
+// emailCheckConfig stores the checks of the client e-mail address, besides the
+// format.
+type emailCheckConfig struct {
+	Disposable     bool
+	DisposableFile string `yaml:"disposable file"`
+	Blocklist      stringList
+	MX             bool `yaml:"mx"`
+	Resolver       string
+	Timeout        time.Duration
+	Cache          time.Duration
+	FailOpen       bool `yaml:"fail open"`
+	Typos          bool
+}
+
+var (
+	// mxResolver is the resolver used to check the domains of the e-mail
+	// addresses.
+	mxResolver *net.Resolver
+
+	// mxCache stores if the domains can receive e-mails.
+	mxCache dnsCache
+)
+
+// domainList is a set of domains that can be replaced while in use.
+type domainList struct {
+	sync.RWMutex
+	domains map[string]bool
+}
+
+// disposableDomains are the bundled disposable domains and the ones from the
+// configured file.
+var disposableDomains domainList
+
+// contains checks if the domain, or one of its parent domains, is in the list.
+func (d *domainList) contains(domain string) bool {
+	d.RLock()
+	defer d.RUnlock()
+
+	for domain != "" {
+		if d.domains[domain] {
+			return true
+		}
+
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	return false
+}
+
+// loadDisposableDomains reads the disposable domains file, one domain per
+// line and lines starting with "#" are comments, together with the bundled
+// domains.
+func loadDisposableDomains() error {
+	domains := make(map[string]bool)
+	for _, domain := range bundledDisposableDomains {
+		domains[domain] = true
+	}
+
+	if config.EmailCheck.DisposableFile != "" {
+		file, err := os.Open(config.EmailCheck.DisposableFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+			if line != "" && !strings.HasPrefix(line, "#") {
+				domains[strings.TrimSuffix(line, ".")] = true
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	disposableDomains.Lock()
+	disposableDomains.domains = domains
+	disposableDomains.Unlock()
+	return nil
+}
+
+// reloadOnSignal reads the disposable domains file again when the service
+// receives the SIGHUP signal.
+func reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		if err := loadDisposableDomains(); err != nil {
+			log.Println("error reloading disposable domains. Details:", err)
+			continue
+		}
+		log.Println("disposable domains reloaded")
+	}
+}
+
+// checkEmail returns why the client e-mail address isn't accepted. An error is
+// returned when the domain couldn't be checked and the check doesn't fail
+// open.
+func checkEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return "", nil
+	}
+	domain := email[strings.LastIndex(email, "@")+1:]
+
+	for _, pattern := range config.EmailCheck.Blocklist {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+
+		if strings.Contains(pattern, "@") {
+			if matched, _ := path.Match(pattern, email); matched {
+				return "e-mail address not allowed", nil
+			}
+
+		} else if matchDomain(domain, pattern) {
+			return "e-mail domain not allowed", nil
+		}
+	}
+
+	if config.EmailCheck.Disposable && disposableDomains.contains(domain) {
+		return "disposable e-mail addresses are not allowed", nil
+	}
+
+	if !config.EmailCheck.MX {
+		return "", nil
+	}
+
+	receives, err := receivesEmail(domain)
+	if err != nil {
+		if config.EmailCheck.FailOpen {
+			log.Printf("error checking e-mail domain “%s”, accepting it anyway. Details: %s", domain, err)
+			return "", nil
+		}
+		return "", err
+
+	} else if !receives {
+		return "e-mail domain can't receive e-mails", nil
+	}
+
+	return "", nil
+}
+
+// receivesEmail checks if the domain has MX records, or A/AAAA records that
+// are used when there's no MX record. Only the answers are cached, not the
+// failures.
+func receivesEmail(domain string) (bool, error) {
+	if result, found := mxCache.get(domain); found {
+		return result, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.EmailCheck.Timeout)
+	defer cancel()
+
+	records, err := mxResolver.LookupMX(ctx, domain)
+	if err != nil && !dnsNotFound(err) {
+		return false, err
+	}
+
+	if len(records) > 0 {
+		// a single "." record is the null MX, of domains that don't receive
+		// e-mails (RFC 7505)
+		result := len(records) > 1 || records[0].Host != "."
+		mxCache.set(domain, result, config.EmailCheck.Cache)
+		return result, nil
+	}
+
+	addresses, err := mxResolver.LookupIPAddr(ctx, domain)
+	if err != nil && !dnsNotFound(err) {
+		return false, err
+	}
+
+	result := len(addresses) > 0
+	mxCache.set(domain, result, config.EmailCheck.Cache)
+	return result, nil
+}
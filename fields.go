@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Possible field types
+const (
+	fieldTypeText     = "text"
+	fieldTypeEmail    = "email"
+	fieldTypePhone    = "phone"
+	fieldTypeNumber   = "number"
+	fieldTypeURL      = "url"
+	fieldTypeSelect   = "select"
+	fieldTypeCheckbox = "checkbox"
+	fieldTypeDate     = "date"
+)
+
+// Validation rules that can have a custom error message
+const (
+	fieldRuleRequired  = "required"
+	fieldRuleType      = "type"
+	fieldRuleMinLength = "min length"
+	fieldRuleMaxLength = "max length"
+	fieldRulePattern   = "pattern"
+	fieldRuleValues    = "values"
+)
+
+var (
+	phoneFormat = regexp.MustCompile(`^\+?[0-9 ().-]{6,20}$`)
+
+	// defaultFields are the fields accepted when the form doesn't define its own
+	// fields.
+	defaultFields = []field{
+		{Name: "name", Type: fieldTypeText},
+		{Name: "email", Type: fieldTypeEmail, Required: true},
+		{Name: "subject", Type: fieldTypeText},
+		{Name: "message", Type: fieldTypeText},
+	}
+
+	// fieldTypeMessages are the default error messages of the type rule.
+	fieldTypeMessages = map[string]string{
+		fieldTypeEmail:    "invalid e-mail address",
+		fieldTypePhone:    "invalid phone number",
+		fieldTypeNumber:   "invalid number",
+		fieldTypeURL:      "invalid URL",
+		fieldTypeCheckbox: "invalid checkbox value",
+		fieldTypeDate:     "invalid date, expected format YYYY-MM-DD",
+	}
+)
+
+// field describes a field of the form and how it is validated.
+type field struct {
+	Name      string
+	Type      string
+	Required  bool
+	MinLength int `yaml:"min length"`
+	MaxLength int `yaml:"max length"`
+	Pattern   string
+	Values    stringList
+	Messages  map[string]string
+
+	// Parsed pattern
+	pattern *regexp.Regexp
+}
+
+// prepare checks the field settings and parses the pattern.
+func (f *field) prepare() error {
+	if f.Name = strings.TrimSpace(f.Name); f.Name == "" {
+		return errors.New("missing field name")
+	}
+
+	if f.Type = strings.ToLower(strings.TrimSpace(f.Type)); f.Type == "" {
+		f.Type = fieldTypeText
+	}
+
+	switch f.Type {
+	case fieldTypeText, fieldTypeEmail, fieldTypePhone, fieldTypeNumber, fieldTypeURL, fieldTypeCheckbox, fieldTypeDate:
+	case fieldTypeSelect:
+		if len(f.Values) == 0 {
+			return fmt.Errorf("field “%s” of type select without values", f.Name)
+		}
+	default:
+		return fmt.Errorf("unknown type “%s” in field “%s”", f.Type, f.Name)
+	}
+
+	if f.MaxLength > 0 && f.MinLength > f.MaxLength {
+		return fmt.Errorf("field “%s” with min length greater than max length", f.Name)
+	}
+
+	if f.Pattern != "" {
+		var err error
+		if f.pattern, err = regexp.Compile(f.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern in field “%s”. Details: %s", f.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// validate checks the value of the field, returning the normalized value or
+// the error message.
+func (f field) validate(value string) (string, string) {
+	if f.Type == fieldTypeCheckbox {
+		switch strings.ToLower(value) {
+		case "", "0", "off", "false", "no":
+			value = ""
+		case "1", "on", "true", "yes":
+			value = "yes"
+		default:
+			return "", f.message(fieldRuleType, fieldTypeMessages[f.Type])
+		}
+	}
+
+	if value == "" {
+		if f.Required {
+			return "", f.message(fieldRuleRequired, "required field")
+		}
+
+		if f.Type == fieldTypeCheckbox {
+			value = "no"
+		}
+		return value, ""
+	}
+
+	valid := true
+	switch f.Type {
+	case fieldTypeEmail:
+		_, err := mail.ParseAddress(value)
+		valid = err == nil
+
+	case fieldTypePhone:
+		valid = phoneFormat.MatchString(value)
+
+	case fieldTypeNumber:
+		_, err := strconv.ParseFloat(value, 64)
+		valid = err == nil
+
+	case fieldTypeURL:
+		u, err := url.ParseRequestURI(value)
+		valid = err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+
+	case fieldTypeDate:
+		_, err := time.Parse("2006-01-02", value)
+		valid = err == nil
+	}
+
+	if !valid {
+		return "", f.message(fieldRuleType, fieldTypeMessages[f.Type])
+	}
+
+	length := utf8.RuneCountInString(value)
+	if f.MinLength > 0 && length < f.MinLength {
+		return "", f.message(fieldRuleMinLength, fmt.Sprintf("must have at least %d characters", f.MinLength))
+	}
+
+	if f.MaxLength > 0 && length > f.MaxLength {
+		return "", f.message(fieldRuleMaxLength, fmt.Sprintf("must have at most %d characters", f.MaxLength))
+	}
+
+	if f.pattern != nil && !f.pattern.MatchString(value) {
+		return "", f.message(fieldRulePattern, "invalid format")
+	}
+
+	if len(f.Values) > 0 && !f.Values.contains(value) {
+		return "", f.message(fieldRuleValues, "invalid value")
+	}
+
+	return value, ""
+}
+
+// message returns the custom error message of the rule, or the default
+// message when there's none.
+func (f field) message(rule, defaultMessage string) string {
+	if message := f.Messages[rule]; message != "" {
+		return message
+	}
+	return defaultMessage
+}
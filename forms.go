@@ -0,0 +1,390 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// formIDFormat restricts the form identifiers to characters that are safe in
+// the URL path.
+var formIDFormat = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// rateLimitConfig stores the token bucket policy.
+type rateLimitConfig struct {
+	Burst   float64
+	Rate    float64
+	Expires time.Duration
+	Cleanup time.Duration
+}
+
+// form is a contact form served by the service. Each form has its own
+// recipients, e-mail settings and rate limit policy, and the missing settings
+// are copied from the main configuration.
+type form struct {
+	ID           string
+	Path         string
+	Mailbox      mailbox
+	Email        emailConfig
+	RateLimit    rateLimitConfig `yaml:"rate limit"`
+	CORS         corsConfig
+	Redirect     redirectConfig
+	Fields       []field
+	BotDetection botDetectionConfig `yaml:"bot detection"`
+	Captcha      captchaConfig
+	ProofOfWork  proofOfWorkConfig `yaml:"proof of work"`
+	Duplicates   duplicatesConfig
+	Spam         spamConfig
+	Attachments  attachmentsConfig
+	Routes       []route
+
+	// Route used when the submission doesn't match any other route
+	defaultRoute route
+
+	ratelimit     map[string]map[string]string
+	ratelimitLock sync.RWMutex
+
+	// Proof-of-work challenges already used and when they expire
+	challenges     map[string]time.Time
+	challengesLock sync.Mutex
+
+	// Submissions remembered to detect the duplicated ones
+	duplicates     map[string]*duplicate
+	duplicatesLock sync.Mutex
+}
+
+// buildForms creates the forms that will be served. The main configuration is
+// also a form answering on "/" when it has a mailbox.
+func buildForms() ([]*form, error) {
+	var list []*form
+	ids := make(map[string]bool)
+	paths := make(map[string]bool)
+
+	if !config.Mailbox.empty() {
+		list = append(list, &form{
+			ID:           "default",
+			Path:         "/",
+			Mailbox:      config.Mailbox,
+			Email:        config.Email,
+			RateLimit:    config.RateLimit,
+			CORS:         config.CORS,
+			Redirect:     config.Redirect,
+			Fields:       config.Fields,
+			BotDetection: config.BotDetection,
+			Captcha:      config.Captcha,
+			ProofOfWork:  config.ProofOfWork,
+			Duplicates:   config.Duplicates,
+			Spam:         config.Spam,
+			Attachments:  config.Attachments,
+			Routes:       config.Routes,
+		})
+
+		ids["default"] = true
+		paths["/"] = true
+	}
+
+	for _, f := range config.Forms {
+		if f.ID = strings.TrimSpace(f.ID); !formIDFormat.MatchString(f.ID) {
+			return nil, fmt.Errorf("invalid form identifier “%s”", f.ID)
+		}
+
+		if ids[f.ID] {
+			return nil, fmt.Errorf("duplicated form identifier “%s”", f.ID)
+		}
+		ids[f.ID] = true
+
+		if f.Path = strings.TrimSpace(f.Path); f.Path == "" {
+			f.Path = "/f/" + f.ID
+		}
+
+		if !strings.HasPrefix(f.Path, "/") || reservedPath(f.Path) || paths[f.Path] {
+			return nil, fmt.Errorf("invalid or duplicated path “%s” in form “%s”", f.Path, f.ID)
+		}
+		paths[f.Path] = true
+
+		list = append(list, f)
+	}
+
+	for _, f := range list {
+		if err := f.prepare(); err != nil {
+			return nil, fmt.Errorf("form “%s”: %s", f.ID, err)
+		}
+	}
+
+	return list, nil
+}
+
+// reservedPath checks if the path is used by the other endpoints of the
+// service.
+func reservedPath(path string) bool {
+	for _, prefix := range []string{downloadPath, tokenPath, challengePath, feedbackPath, moderationPath} {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// controlField checks if the field is used by the service itself (honeypot,
+// tokens, challenges and CAPTCHA), so it isn't part of the submission. The
+// control fields start with "_".
+func (f *form) controlField(name string) bool {
+	return strings.HasPrefix(name, "_") ||
+		(f.BotDetection.Honeypot != "" && name == f.BotDetection.Honeypot) ||
+		(f.Captcha.Provider != "" && name == f.Captcha.Field)
+}
+
+// findForm returns the form with the given identifier. When the identifier is
+// empty the first form is returned.
+func findForm(id string) *form {
+	for _, f := range forms {
+		if id == "" || f.ID == id {
+			return f
+		}
+	}
+	return nil
+}
+
+// prepare fills the form with the main configuration settings when missing,
+// and parses the addresses and templates.
+func (f *form) prepare() error {
+	if f.Mailbox.empty() {
+		f.Mailbox = config.Mailbox
+	}
+
+	if f.Mailbox.empty() {
+		return fmt.Errorf("missing mailbox")
+	}
+
+	if f.Email.SubjectPrefix == "" {
+		f.Email.SubjectPrefix = config.Email.SubjectPrefix
+	}
+
+	if f.Email.Template = strings.TrimSpace(f.Email.Template); f.Email.Template == "" {
+		f.Email.Template = config.Email.Template
+	}
+
+	if f.RateLimit.Burst == 0 {
+		f.RateLimit.Burst = config.RateLimit.Burst
+	}
+
+	if f.RateLimit.Rate == 0 {
+		f.RateLimit.Rate = config.RateLimit.Rate
+	}
+
+	if f.RateLimit.Expires.Seconds() == 0 {
+		f.RateLimit.Expires = config.RateLimit.Expires
+	}
+
+	if len(f.CORS.AllowedOrigins) == 0 {
+		f.CORS.AllowedOrigins = config.CORS.AllowedOrigins
+	}
+
+	if len(f.CORS.AllowedHeaders) == 0 {
+		f.CORS.AllowedHeaders = config.CORS.AllowedHeaders
+	}
+
+	if f.CORS.MaxAge.Seconds() == 0 {
+		f.CORS.MaxAge = config.CORS.MaxAge
+	}
+
+	if f.Redirect.SuccessURL = strings.TrimSpace(f.Redirect.SuccessURL); f.Redirect.SuccessURL == "" {
+		f.Redirect.SuccessURL = strings.TrimSpace(config.Redirect.SuccessURL)
+	}
+
+	if f.Redirect.ErrorURL = strings.TrimSpace(f.Redirect.ErrorURL); f.Redirect.ErrorURL == "" {
+		f.Redirect.ErrorURL = strings.TrimSpace(config.Redirect.ErrorURL)
+	}
+
+	if len(f.Redirect.AllowedHosts) == 0 {
+		f.Redirect.AllowedHosts = config.Redirect.AllowedHosts
+	}
+
+	if err := f.Redirect.validate(); err != nil {
+		return err
+	}
+
+	if f.BotDetection.Honeypot = strings.TrimSpace(f.BotDetection.Honeypot); f.BotDetection.Honeypot == "" {
+		f.BotDetection.Honeypot = strings.TrimSpace(config.BotDetection.Honeypot)
+	}
+
+	if f.BotDetection.MinFillTime == 0 {
+		f.BotDetection.MinFillTime = config.BotDetection.MinFillTime
+	}
+
+	if f.BotDetection.MaxAge == 0 {
+		f.BotDetection.MaxAge = config.BotDetection.MaxAge
+	}
+
+	// the CAPTCHA settings are only copied together, so the provider settings
+	// are never mixed
+	if strings.TrimSpace(f.Captcha.Provider) == "" {
+		f.Captcha = config.Captcha
+	}
+
+	if err := f.Captcha.prepare(); err != nil {
+		return err
+	}
+
+	if f.ProofOfWork.Difficulty == 0 {
+		f.ProofOfWork.Difficulty = config.ProofOfWork.Difficulty
+	}
+
+	if f.ProofOfWork.ThrottledDifficulty == 0 {
+		f.ProofOfWork.ThrottledDifficulty = config.ProofOfWork.ThrottledDifficulty
+	}
+
+	if f.ProofOfWork.Expires.Seconds() == 0 {
+		f.ProofOfWork.Expires = config.ProofOfWork.Expires
+	}
+
+	if err := f.ProofOfWork.validate(); err != nil {
+		return err
+	}
+
+	if f.Duplicates.Window == 0 {
+		f.Duplicates.Window = config.Duplicates.Window
+	}
+
+	if f.Duplicates.MaxEntries <= 0 {
+		f.Duplicates.MaxEntries = config.Duplicates.MaxEntries
+	}
+
+	// the spam rules are only copied together, as they are calibrated with the
+	// scores
+	if !f.Spam.enabled() {
+		f.Spam = config.Spam
+	}
+
+	if err := f.Spam.prepare(); err != nil {
+		return err
+	}
+
+	if f.Attachments.MaxFiles == 0 {
+		f.Attachments.MaxFiles = config.Attachments.MaxFiles
+	}
+
+	if f.Attachments.MaxFileSize == 0 {
+		f.Attachments.MaxFileSize = config.Attachments.MaxFileSize
+	}
+
+	if f.Attachments.MaxTotalSize == 0 {
+		f.Attachments.MaxTotalSize = config.Attachments.MaxTotalSize
+	}
+
+	if len(f.Attachments.AllowedTypes) == 0 {
+		f.Attachments.AllowedTypes = config.Attachments.AllowedTypes
+	}
+
+	if f.Attachments.Storage = strings.ToLower(strings.TrimSpace(f.Attachments.Storage)); f.Attachments.Storage == "" {
+		f.Attachments.Storage = config.Attachments.Storage
+	}
+
+	if f.Attachments.Directory = strings.TrimSpace(f.Attachments.Directory); f.Attachments.Directory == "" {
+		f.Attachments.Directory = config.Attachments.Directory
+	}
+
+	if f.Attachments.Retention.Seconds() == 0 {
+		f.Attachments.Retention = config.Attachments.Retention
+	}
+
+	switch f.Attachments.Storage {
+	case attachmentsStorageEmail:
+	case attachmentsStorageDisk:
+		if config.URL == "" {
+			return errors.New("missing service URL for the attachment download links")
+		}
+	default:
+		return fmt.Errorf("unknown attachments storage “%s”", f.Attachments.Storage)
+	}
+
+	if err := f.prepareFields(); err != nil {
+		return err
+	}
+
+	f.ratelimit = make(map[string]map[string]string)
+	f.challenges = make(map[string]time.Time)
+	f.duplicates = make(map[string]*duplicate)
+
+	return f.prepareRoutes()
+}
+
+// prepareFields copies the fields definition from the main configuration, or
+// uses the default fields, when the form doesn't define its own fields.
+func (f *form) prepareFields() error {
+	if len(f.Fields) == 0 {
+		f.Fields = append(f.Fields, config.Fields...)
+	}
+
+	if len(f.Fields) == 0 {
+		f.Fields = append(f.Fields, defaultFields...)
+	}
+
+	names := make(map[string]bool)
+	for i := range f.Fields {
+		if err := f.Fields[i].prepare(); err != nil {
+			return err
+		}
+
+		if names[f.Fields[i].Name] {
+			return fmt.Errorf("duplicated field “%s”", f.Fields[i].Name)
+		}
+		names[f.Fields[i].Name] = true
+	}
+
+	return nil
+}
+
+// findRoute returns the first route that matches the submission, or the
+// default route built from the form mailbox and e-mail settings.
+func (f *form) findRoute(input submission) *route {
+	for i := range f.Routes {
+		if f.Routes[i].match(input) {
+			return &f.Routes[i]
+		}
+	}
+	return &f.defaultRoute
+}
+
+// prepareRoutes fills the routes with the form settings when missing and
+// parses the routes templates.
+func (f *form) prepareRoutes() error {
+	f.defaultRoute = route{
+		Name:    "default",
+		Mailbox: f.Mailbox,
+		Email:   f.Email,
+	}
+
+	if err := f.defaultRoute.prepare(); err != nil {
+		return err
+	}
+
+	for i := range f.Routes {
+		r := &f.Routes[i]
+
+		if r.Name = strings.TrimSpace(r.Name); r.Name == "" {
+			r.Name = fmt.Sprintf("route %d", i+1)
+		}
+
+		if r.Mailbox.empty() {
+			r.Mailbox = f.Mailbox
+		}
+
+		if r.Email.SubjectPrefix == "" {
+			r.Email.SubjectPrefix = f.Email.SubjectPrefix
+		}
+
+		if r.Email.Template = strings.TrimSpace(r.Email.Template); r.Email.Template == "" {
+			r.Email.Template = f.Email.Template
+		}
+
+		if err := r.prepare(); err != nil {
+			return fmt.Errorf("%s: %s", r.Name, err)
+		}
+	}
+
+	return nil
+}
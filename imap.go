@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Possible TLS modes when talking to an IMAP server
+const (
+	imapTLSImplicit = "tls"
+	imapTLSStartTLS = "starttls"
+	imapTLSNone     = "none"
+)
+
+// imapTransport stores the message directly in an IMAP folder using the
+// APPEND command, instead of sending it to a mailbox.
+type imapTransport struct {
+	Address            string
+	Username           string
+	Password           string
+	TLS                string
+	InsecureSkipVerify bool `yaml:"insecure skip verify"`
+	Folder             string
+	Flags              []string
+	Timeout            time.Duration
+}
+
+func (i *imapTransport) send(from string, to []string, message io.WriterTo) error {
+	host, _, err := net.SplitHostPort(i.Address)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: i.InsecureSkipVerify,
+	}
+
+	dialer := &net.Dialer{Timeout: i.Timeout}
+
+	var conn net.Conn
+	if i.TLS == imapTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", i.Address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", i.Address)
+	}
+
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(i.Timeout))
+
+	session := &imapSession{conn: conn, reader: bufio.NewReader(conn)}
+
+	greeting, err := session.readLine()
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(greeting, "* OK") {
+		return fmt.Errorf("unexpected IMAP greeting “%s”", greeting)
+	}
+
+	if i.TLS == imapTLSStartTLS {
+		if err := session.cmd("STARTTLS"); err != nil {
+			return err
+		}
+
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+
+		session.conn = tlsConn
+		session.reader = bufio.NewReader(tlsConn)
+	}
+
+	if err := session.cmd("LOGIN %s %s", imapQuote(i.Username), imapQuote(i.Password)); err != nil {
+		return err
+	}
+
+	// the literal size is sent before the message, so the message is written
+	// twice instead of being kept in memory
+	size := &countingWriter{w: io.Discard}
+	if _, err := message.WriteTo(&crlfLineBreaksWriter{w: size}); err != nil {
+		return err
+	}
+
+	id, err := session.send("APPEND %s (%s) {%d}",
+		imapQuote(i.Folder), strings.Join(i.Flags, " "), size.n)
+	if err != nil {
+		return err
+	}
+
+	// wait for the server to accept the literal with the message
+	continuation, err := session.readLine()
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(continuation, "+") {
+		return fmt.Errorf("IMAP server refused the message “%s”", continuation)
+	}
+
+	writer := bufio.NewWriter(session.conn)
+	if _, err := message.WriteTo(&crlfLineBreaksWriter{w: writer}); err != nil {
+		return err
+	}
+
+	if _, err := writer.WriteString("\r\n"); err != nil {
+		return err
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	if err := session.wait(id); err != nil {
+		return err
+	}
+
+	// the message is already stored, so we don't care about errors here
+	session.cmd("LOGOUT")
+	return nil
+}
+
+// imapSession controls the tagged commands of an IMAP connection.
+type imapSession struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	tag    int
+}
+
+// cmd sends a command and waits for its tagged response.
+func (s *imapSession) cmd(format string, args ...interface{}) error {
+	id, err := s.send(format, args...)
+	if err != nil {
+		return err
+	}
+
+	return s.wait(id)
+}
+
+// send writes a command with a new tag, returning the tag.
+func (s *imapSession) send(format string, args ...interface{}) (string, error) {
+	s.tag++
+	id := fmt.Sprintf("a%d", s.tag)
+
+	_, err := fmt.Fprintf(s.conn, id+" "+format+"\r\n", args...)
+	return id, err
+}
+
+// wait ignores the untagged responses until the tagged response arrives,
+// checking if the command succeeded.
+func (s *imapSession) wait(id string) error {
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return err
+		}
+
+		if !strings.HasPrefix(line, id+" ") {
+			continue
+		}
+
+		status := strings.TrimPrefix(line, id+" ")
+		if strings.HasPrefix(strings.ToUpper(status), "OK") {
+			return nil
+		}
+
+		return fmt.Errorf("IMAP command failed “%s”", status)
+	}
+}
+
+func (s *imapSession) readLine() (string, error) {
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// imapQuote converts the text to an IMAP quoted string.
+func imapQuote(text string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(text) + `"`
+}
+
+// crlfLineBreaksWriter converts all the message line breaks to the network
+// format (CRLF) while the message is written.
+type crlfLineBreaksWriter struct {
+	w  io.Writer
+	cr bool
+}
+
+func (c *crlfLineBreaksWriter) Write(data []byte) (int, error) {
+	converted := make([]byte, 0, len(data)+len(data)/64)
+	for _, b := range data {
+		if b == '\n' && !c.cr {
+			converted = append(converted, '\r')
+		}
+		converted = append(converted, b)
+		c.cr = b == '\r'
+	}
+
+	if _, err := c.w.Write(converted); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// imapAppendCommand matches the APPEND command, capturing the folder, flags
+// and literal size.
+var imapAppendCommand = regexp.MustCompile(`^(a\d+) APPEND (".*") \((.*)\) \{(\d+)\}$`)
+
+// fakeIMAP accepts the commands used to store a message, sending the APPEND
+// command and the literal received in the channel.
+func fakeIMAP(t *testing.T) (string, chan []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening. Details: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	appended := make(chan []string, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		fmt.Fprint(conn, "* OK IMAP4rev1 ready\r\n")
+
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			tag := strings.SplitN(line, " ", 2)[0]
+
+			match := imapAppendCommand.FindStringSubmatch(line)
+			if match == nil {
+				fmt.Fprintf(conn, "%s OK done\r\n", tag)
+				continue
+			}
+
+			size, _ := strconv.Atoi(match[4])
+			fmt.Fprint(conn, "+ Ready for literal data\r\n")
+
+			literal := make([]byte, size)
+			if _, err := io.ReadFull(reader, literal); err != nil {
+				return
+			}
+
+			// the command ends with the line break after the literal
+			if end, err := reader.ReadString('\n'); err != nil || end != "\r\n" {
+				fmt.Fprintf(conn, "%s BAD literal size mismatch\r\n", tag)
+				return
+			}
+
+			appended <- []string{match[2], match[3], string(literal)}
+			fmt.Fprintf(conn, "%s OK APPEND completed\r\n", tag)
+		}
+	}()
+
+	return listener.Addr().String(), appended
+}
+
+func TestIMAPAppend(t *testing.T) {
+	address, appended := fakeIMAP(t)
+
+	transport := imapTransport{
+		Address:  address,
+		Username: "user",
+		Password: `pass"word`,
+		TLS:      imapTLSNone,
+		Folder:   "INBOX",
+		Flags:    []string{`\Seen`},
+		Timeout:  time.Second,
+	}
+
+	message := "Subject: test\nFrom: john@example.com\r\n\nHello\n"
+	if err := transport.send("john@example.com", nil, rawMessage(message)); err != nil {
+		t.Fatalf("unexpected error appending message. Details: %s", err)
+	}
+
+	var result []string
+	select {
+	case result = <-appended:
+	case <-time.After(time.Second):
+		t.Fatal("message not appended")
+	}
+
+	if result[0] != `"INBOX"` || result[1] != `\Seen` {
+		t.Errorf("unexpected folder %s or flags %s", result[0], result[1])
+	}
+
+	expected := "Subject: test\r\nFrom: john@example.com\r\n\r\nHello\r\n"
+	if result[2] != expected {
+		t.Errorf("unexpected literal %q (expected %q)", result[2], expected)
+	}
+}
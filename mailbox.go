@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// mailbox stores the recipients of the e-mails. In the configuration file it
+// can be a single address, a list of addresses (both used as "to") or the
+// "to", "cc" and "bcc" lists.
+type mailbox struct {
+	To  stringList
+	Cc  stringList
+	Bcc stringList
+
+	// parsed addresses
+	to, cc, bcc []*mail.Address
+}
+
+func (m *mailbox) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var to stringList
+	if err := unmarshal(&to); err == nil {
+		*m = mailbox{To: to}
+		return nil
+	}
+
+	var recipients struct {
+		To  stringList
+		Cc  stringList
+		Bcc stringList
+	}
+
+	if err := unmarshal(&recipients); err != nil {
+		return err
+	}
+
+	*m = mailbox{
+		To:  recipients.To,
+		Cc:  recipients.Cc,
+		Bcc: recipients.Bcc,
+	}
+	return nil
+}
+
+// empty checks if there's no recipient at all. Blank items (e.g. mailbox: "")
+// don't count as recipients.
+func (m mailbox) empty() bool {
+	for _, list := range []stringList{m.To, m.Cc, m.Bcc} {
+		for _, item := range list {
+			if strings.TrimSpace(item) != "" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// parse validates the recipients addresses. Each item can also contain many
+// addresses separated by comma. At least one address is required, as the
+// e-mails would have nowhere to go.
+func (m *mailbox) parse() error {
+	var err error
+	if m.to, err = parseAddressList(m.To); err != nil {
+		return err
+	}
+
+	if m.cc, err = parseAddressList(m.Cc); err != nil {
+		return err
+	}
+
+	if m.bcc, err = parseAddressList(m.Bcc); err != nil {
+		return err
+	}
+
+	if len(m.recipients()) == 0 {
+		return errors.New("missing recipients")
+	}
+	return nil
+}
+
+// header returns the recipients headers of the e-mail. Blind carbon copies are
+// never visible in the e-mail.
+func (m mailbox) header() map[string]string {
+	header := make(map[string]string)
+	if len(m.to) > 0 {
+		header["To"] = formatAddressList(m.to)
+	}
+	if len(m.cc) > 0 {
+		header["Cc"] = formatAddressList(m.cc)
+	}
+	return header
+}
+
+// recipients returns the addresses used in the SMTP envelope.
+func (m mailbox) recipients() []string {
+	var recipients []string
+	for _, list := range [][]*mail.Address{m.to, m.cc, m.bcc} {
+		for _, address := range list {
+			recipients = append(recipients, address.Address)
+		}
+	}
+	return recipients
+}
+
+func parseAddressList(items []string) ([]*mail.Address, error) {
+	var addresses []*mail.Address
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		list, err := mail.ParseAddressList(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address “%s”. Details: %s", item, err)
+		}
+		addresses = append(addresses, list...)
+	}
+	return addresses, nil
+}
+
+func formatAddressList(addresses []*mail.Address) string {
+	var formatted []string
+	for _, address := range addresses {
+		formatted = append(formatted, address.String())
+	}
+	return strings.Join(formatted, ", ")
+}
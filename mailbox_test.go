@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestMailboxEmpty(t *testing.T) {
+	scenarios := []struct {
+		mailbox  mailbox
+		expected bool
+	}{
+		{mailbox: mailbox{}, expected: true},
+		{mailbox: mailbox{To: stringList{""}}, expected: true},
+		{mailbox: mailbox{To: stringList{"  "}, Cc: stringList{""}}, expected: true},
+		{mailbox: mailbox{To: stringList{"me@example.com"}}, expected: false},
+		{mailbox: mailbox{Bcc: stringList{"me@example.com"}}, expected: false},
+	}
+
+	for i, scenario := range scenarios {
+		if empty := scenario.mailbox.empty(); empty != scenario.expected {
+			t.Errorf("scenario %d: unexpected empty %t", i, empty)
+		}
+	}
+}
+
+func TestMailboxParse(t *testing.T) {
+	m := mailbox{To: stringList{"Me <me@example.com>, other@example.com"}, Bcc: stringList{"hidden@example.com"}}
+	if err := m.parse(); err != nil {
+		t.Fatalf("unexpected error parsing mailbox. Details: %s", err)
+	}
+
+	if recipients := m.recipients(); len(recipients) != 3 || recipients[2] != "hidden@example.com" {
+		t.Errorf("unexpected recipients %v", recipients)
+	}
+
+	if _, found := m.header()["Bcc"]; found {
+		t.Error("blind carbon copies in the e-mail header")
+	}
+
+	for _, m := range []mailbox{{}, {To: stringList{" "}}} {
+		if err := m.parse(); err == nil {
+			t.Errorf("expected error parsing mailbox without recipients %v", m.To)
+		}
+	}
+
+	m = mailbox{To: stringList{"not an address"}}
+	if err := m.parse(); err == nil {
+		t.Error("expected error parsing invalid address")
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Possible TLS modes when talking to a mail server
+const (
+	mailserverTLSOpportunistic = ""
+	mailserverTLSStartTLS      = "starttls"
+	mailserverTLSImplicit      = "tls"
+	mailserverTLSNone          = "none"
+)
+
+// errNoMailserverAvailable is returned when all mail servers are with their
+// circuit breakers open.
+var errNoMailserverAvailable = errors.New("no mail server available")
+
+// mailserver stores the information of a SMTP relay that can be used to
+// deliver the e-mails.
+type mailserver struct {
+	Address            string
+	Username           string
+	Password           string
+	TLS                string
+	InsecureSkipVerify bool `yaml:"insecure skip verify"`
+	Weight             int
+	Timeout            time.Duration
+
+	breaker *circuitBreaker
+}
+
+// mailservers is the list of SMTP relays. In the configuration file it can be
+// a single mail server or a list of mail servers.
+type mailservers []mailserver
+
+func (m *mailservers) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []mailserver
+	if err := unmarshal(&list); err == nil {
+		*m = list
+		return nil
+	}
+
+	var single mailserver
+	if err := unmarshal(&single); err != nil {
+		return err
+	}
+
+	*m = mailservers{single}
+	return nil
+}
+
+// send tries the mail servers one by one until one of them accepts the
+// message. Connection, authentication and temporary (4xx) errors move to the
+// next mail server, while a permanent (5xx) error is returned immediately, as
+// the other mail servers would probably refuse the message too.
+func (m mailservers) send(from string, to []string, message io.WriterTo) error {
+	var errs []string
+
+	for _, server := range m.sequence() {
+		if !server.breaker.allow() {
+			continue
+		}
+
+		failover, err := server.send(from, to, message)
+		if err == nil {
+			server.breaker.success()
+			return nil
+		}
+
+		if !failover {
+			// the mail server is alive, it just didn't like the message
+			server.breaker.success()
+			return err
+		}
+
+		server.breaker.failure()
+		log.Printf("error sending e-mail via mail server “%s”, trying the next one. Details: %s",
+			server.Address, err)
+		errs = append(errs, fmt.Sprintf("%s: %s", server.Address, err))
+	}
+
+	if len(errs) == 0 {
+		return errNoMailserverAvailable
+	}
+
+	return fmt.Errorf("all mail servers failed (%s)", strings.Join(errs, "; "))
+}
+
+// sequence returns the order that the mail servers should be tried. When no
+// weight is defined the configuration order is used. Otherwise the mail
+// servers with weight are shuffled proportionally to their weights, and the
+// ones without weight are left at the end as backups.
+func (m mailservers) sequence() []*mailserver {
+	var weighted, backups []*mailserver
+	totalWeight := 0
+
+	for i := range m {
+		if m[i].Weight > 0 {
+			weighted = append(weighted, &m[i])
+			totalWeight += m[i].Weight
+		} else {
+			backups = append(backups, &m[i])
+		}
+	}
+
+	var sequence []*mailserver
+	for len(weighted) > 0 {
+		n := rand.Intn(totalWeight)
+		for i, server := range weighted {
+			if n -= server.Weight; n < 0 {
+				sequence = append(sequence, server)
+				totalWeight -= server.Weight
+				weighted = append(weighted[:i], weighted[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return append(sequence, backups...)
+}
+
+// send delivers the message using this mail server. It also informs if the
+// error allows trying another mail server or not.
+func (s *mailserver) send(from string, to []string, message io.WriterTo) (failover bool, err error) {
+	host, _, err := net.SplitHostPort(s.Address)
+	if err != nil {
+		return true, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: s.InsecureSkipVerify,
+	}
+
+	dialer := &net.Dialer{Timeout: s.Timeout}
+
+	var conn net.Conn
+	if s.TLS == mailserverTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.Address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", s.Address)
+	}
+
+	if err != nil {
+		return true, err
+	}
+	conn.SetDeadline(time.Now().Add(s.Timeout))
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return true, err
+	}
+	defer client.Close()
+
+	if s.TLS == mailserverTLSOpportunistic || s.TLS == mailserverTLSStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return true, err
+			}
+
+		} else if s.TLS == mailserverTLSStartTLS {
+			return true, errors.New("mail server doesn't support STARTTLS")
+		}
+	}
+
+	if s.Username != "" && s.Password != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return true, err
+		}
+	}
+
+	if err := client.Mail(from); err != nil {
+		return smtpFailover(err), err
+	}
+
+	// recipients permanently rejected are ignored, so the message still
+	// reaches the accepted ones
+	var accepted int
+	var rejected []string
+
+	for _, recipient := range to {
+		if err := client.Rcpt(recipient); err != nil {
+			if smtpFailover(err) {
+				return true, err
+			}
+
+			rejected = append(rejected, fmt.Sprintf("%s: %s", recipient, err))
+			continue
+		}
+		accepted++
+	}
+
+	if accepted == 0 {
+		return false, fmt.Errorf("all recipients rejected (%s)", strings.Join(rejected, "; "))
+	}
+
+	if len(rejected) > 0 {
+		log.Printf("recipients rejected by mail server “%s”. Details: %s",
+			s.Address, strings.Join(rejected, "; "))
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return smtpFailover(err), err
+	}
+
+	if _, err := message.WriteTo(w); err != nil {
+		return true, err
+	}
+
+	if err := w.Close(); err != nil {
+		return smtpFailover(err), err
+	}
+
+	// the message was already accepted, so we don't care about errors here
+	client.Quit()
+	return false, nil
+}
+
+// smtpFailover checks if the error returned by the mail server is permanent
+// (5xx), otherwise another mail server can be tried.
+func smtpFailover(err error) bool {
+	var protocolErr *textproto.Error
+	if errors.As(err, &protocolErr) {
+		return protocolErr.Code < 500
+	}
+	return true
+}
+
+// circuitBreaker avoids trying a mail server that failed too many times in a
+// row. After the timeout a single attempt is allowed to check if the mail
+// server is back.
+type circuitBreaker struct {
+	sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func (c *circuitBreaker) allow() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.failures < config.CircuitBreaker.Failures {
+		return true
+	}
+
+	now := time.Now()
+	if now.Before(c.openUntil) {
+		return false
+	}
+
+	// only one attempt while we don't know if the mail server is back
+	c.openUntil = now.Add(config.CircuitBreaker.Timeout)
+	return true
+}
+
+func (c *circuitBreaker) success() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.failures = 0
+}
+
+func (c *circuitBreaker) failure() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.failures++
+	if c.failures >= config.CircuitBreaker.Failures {
+		c.openUntil = time.Now().Add(config.CircuitBreaker.Timeout)
+	}
+}
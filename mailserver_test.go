@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is a mail server that answers the MAIL command with the given
+// reply, counting the connections and the messages accepted.
+type fakeSMTP struct {
+	mailReply string
+
+	lock        sync.Mutex
+	connections int
+	messages    []string
+}
+
+func newFakeSMTP(t *testing.T, mailReply string) (*fakeSMTP, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening. Details: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &fakeSMTP{mailReply: mailReply}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+
+	return server, listener.Addr().String()
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+
+	f.lock.Lock()
+	f.connections++
+	f.lock.Unlock()
+
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		switch command := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			fmt.Fprint(conn, "250 localhost\r\n")
+		case strings.HasPrefix(command, "MAIL"):
+			fmt.Fprint(conn, f.mailReply+"\r\n")
+		case strings.HasPrefix(command, "RCPT"):
+			fmt.Fprint(conn, "250 OK\r\n")
+		case command == "DATA":
+			fmt.Fprint(conn, "354 go ahead\r\n")
+
+			var message strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				message.WriteString(line)
+			}
+
+			f.lock.Lock()
+			f.messages = append(f.messages, message.String())
+			f.lock.Unlock()
+			fmt.Fprint(conn, "250 queued\r\n")
+		case command == "QUIT":
+			fmt.Fprint(conn, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "250 OK\r\n")
+		}
+	}
+}
+
+// stats returns the number of connections and messages received.
+func (f *fakeSMTP) stats() (connections, messages int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.connections, len(f.messages)
+}
+
+// refusedAddress returns an address where no one is listening.
+func refusedAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening. Details: %s", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	return address
+}
+
+func testMailservers(addresses ...string) mailservers {
+	var m mailservers
+	for _, address := range addresses {
+		m = append(m, mailserver{
+			Address: address,
+			TLS:     mailserverTLSNone,
+			Timeout: time.Second,
+			breaker: new(circuitBreaker),
+		})
+	}
+	return m
+}
+
+func TestMailserversFailover(t *testing.T) {
+	originalBreaker := config.CircuitBreaker
+	t.Cleanup(func() { config.CircuitBreaker = originalBreaker })
+	config.CircuitBreaker.Failures = 3
+	config.CircuitBreaker.Timeout = time.Minute
+
+	temporary, temporaryAddress := newFakeSMTP(t, "451 try again later")
+	accepting, acceptingAddress := newFakeSMTP(t, "250 OK")
+
+	m := testMailservers(refusedAddress(t), temporaryAddress, acceptingAddress)
+	if err := m.send("john@example.com", []string{"me@example.com"}, rawMessage("Subject: test\r\n\r\nHello\r\n")); err != nil {
+		t.Fatalf("unexpected error sending e-mail. Details: %s", err)
+	}
+
+	if connections, messages := temporary.stats(); connections != 1 || messages != 0 {
+		t.Errorf("unexpected %d connections and %d messages in the mail server with temporary error", connections, messages)
+	}
+
+	if connections, messages := accepting.stats(); connections != 1 || messages != 1 {
+		t.Errorf("unexpected %d connections and %d messages in the mail server that accepts", connections, messages)
+	}
+}
+
+func TestMailserversPermanentError(t *testing.T) {
+	originalBreaker := config.CircuitBreaker
+	t.Cleanup(func() { config.CircuitBreaker = originalBreaker })
+	config.CircuitBreaker.Failures = 3
+	config.CircuitBreaker.Timeout = time.Minute
+
+	_, rejectingAddress := newFakeSMTP(t, "550 sender rejected")
+	accepting, acceptingAddress := newFakeSMTP(t, "250 OK")
+
+	m := testMailservers(rejectingAddress, acceptingAddress)
+	err := m.send("john@example.com", []string{"me@example.com"}, rawMessage("Subject: test\r\n\r\nHello\r\n"))
+	if err == nil || !strings.Contains(err.Error(), "550") {
+		t.Errorf("unexpected error for permanent failure: %v", err)
+	}
+
+	if connections, _ := accepting.stats(); connections != 0 {
+		t.Errorf("next mail server tried %d times after a permanent error", connections)
+	}
+
+	// the mail server that refused the message is still alive
+	if m[0].breaker.failures != 0 {
+		t.Errorf("unexpected %d failures after a permanent error", m[0].breaker.failures)
+	}
+}
+
+func TestMailserversCircuitBreaker(t *testing.T) {
+	originalBreaker := config.CircuitBreaker
+	t.Cleanup(func() { config.CircuitBreaker = originalBreaker })
+	config.CircuitBreaker.Failures = 2
+	config.CircuitBreaker.Timeout = time.Minute
+
+	failing, failingAddress := newFakeSMTP(t, "421 service not available")
+	accepting, acceptingAddress := newFakeSMTP(t, "250 OK")
+
+	m := testMailservers(failingAddress, acceptingAddress)
+	for i := 0; i < 4; i++ {
+		if err := m.send("john@example.com", []string{"me@example.com"}, rawMessage("Subject: test\r\n\r\nHello\r\n")); err != nil {
+			t.Fatalf("unexpected error sending e-mail %d. Details: %s", i, err)
+		}
+	}
+
+	if connections, _ := failing.stats(); connections != 2 {
+		t.Errorf("failing mail server tried %d times (expected 2)", connections)
+	}
+
+	if _, messages := accepting.stats(); messages != 4 {
+		t.Errorf("unexpected %d messages in the mail server that accepts", messages)
+	}
+
+	// all mail servers with the circuit breaker open
+	m[1].breaker.failures = config.CircuitBreaker.Failures
+	m[1].breaker.openUntil = time.Now().Add(time.Minute)
+
+	if err := m.send("john@example.com", []string{"me@example.com"}, rawMessage("Hello")); err != errNoMailserverAvailable {
+		t.Errorf("unexpected error with all circuit breakers open: %v", err)
+	}
+}
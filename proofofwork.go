@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/bits"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// challengePath is where the forms issue the proof-of-work challenges,
+// followed by the form identifier.
+const challengePath = "/challenge/"
+
+// Hidden fields that carry the challenge and the solution found by the
+// browser
+const (
+	challengeField = "_challenge"
+	solutionField  = "_solution"
+)
+
+// maxProofOfWorkDifficulty avoids challenges that a browser would never solve.
+const maxProofOfWorkDifficulty = 32
+
+// proofOfWorkConfig stores the difficulty of the challenges, that is the
+// number of leading zero bits of the SHA-256 hash of the challenge and the
+// solution. When the difficulty is zero there's no challenge.
+type proofOfWorkConfig struct {
+	Difficulty          int
+	ThrottledDifficulty int `yaml:"throttled difficulty"`
+	Expires             time.Duration
+}
+
+// validate checks if the challenges can be solved.
+func (p proofOfWorkConfig) validate() error {
+	if p.Difficulty < 0 || p.Difficulty > maxProofOfWorkDifficulty ||
+		p.ThrottledDifficulty < 0 || p.ThrottledDifficulty > maxProofOfWorkDifficulty {
+		return fmt.Errorf("proof-of-work difficulty must be between 0 and %d", maxProofOfWorkDifficulty)
+	}
+	return nil
+}
+
+// challengeDifficulty returns the difficulty of the challenges for the IP,
+// that is higher when the rate limit already denied e-mails from it.
+func (f *form) challengeDifficulty(ip string) int {
+	if f.ProofOfWork.ThrottledDifficulty > f.ProofOfWork.Difficulty && f.throttled(ip) {
+		return f.ProofOfWork.ThrottledDifficulty
+	}
+	return f.ProofOfWork.Difficulty
+}
+
+// newChallenge creates a challenge signed for the IP, with the random nonce,
+// difficulty and expiration.
+func (f *form) newChallenge(ip string) (string, int, time.Time, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", 0, time.Time{}, err
+	}
+
+	difficulty := f.challengeDifficulty(ip)
+	expires := time.Now().Add(f.ProofOfWork.Expires)
+
+	parts := []string{
+		hex.EncodeToString(nonce),
+		strconv.Itoa(difficulty),
+		strconv.FormatInt(expires.Unix(), 10),
+	}
+	signature := sign("challenge", f.ID, ip, parts[0], parts[1], parts[2])
+
+	return strings.Join(append(parts, signature), "."), difficulty, expires, nil
+}
+
+// checkChallenge verifies the solution of the challenge, returning why it was
+// rejected. A challenge can only be used once.
+func (f *form) checkChallenge(ip, challenge, solution string) string {
+	if challenge == "" || solution == "" {
+		return "missing challenge or solution"
+	}
+
+	if len(solution) > 64 {
+		return "invalid solution"
+	}
+
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 4 || !validSignature(parts[3], "challenge", f.ID, ip, parts[0], parts[1], parts[2]) {
+		return "invalid challenge"
+	}
+
+	difficulty, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "invalid challenge"
+	}
+
+	// the IP could be throttled after receiving the challenge
+	if difficulty < f.challengeDifficulty(ip) {
+		return "challenge difficulty too low"
+	}
+
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "expired challenge"
+	}
+
+	hash := sha256.Sum256([]byte(challenge + solution))
+	if leadingZeroBits(hash[:]) < difficulty {
+		return "wrong solution"
+	}
+
+	f.challengesLock.Lock()
+	defer f.challengesLock.Unlock()
+
+	if _, used := f.challenges[parts[0]]; used {
+		return "challenge already used"
+	}
+	f.challenges[parts[0]] = time.Unix(expires, 0)
+
+	return ""
+}
+
+// cleanupChallenges forgets the used challenges that already expired, as they
+// can't be replayed anymore.
+func (f *form) cleanupChallenges() {
+	now := time.Now()
+
+	f.challengesLock.Lock()
+	defer f.challengesLock.Unlock()
+
+	for nonce, expires := range f.challenges {
+		if now.After(expires) {
+			delete(f.challenges, nonce)
+		}
+	}
+}
+
+// handleChallenge issues a new challenge for the form. The browser must find a
+// solution where the SHA-256 hash of the challenge followed by the solution
+// has the difficulty number of leading zero bits, and send both in the
+// "_challenge" and "_solution" fields.
+func (f *form) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	if !f.handleCORS(w, r) {
+		return
+	}
+
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		log.Println("invalid remote address. Details:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	challenge, difficulty, expires, err := f.newChallenge(ip)
+	if err != nil {
+		log.Println("error generating challenge. Details:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	err = json.NewEncoder(w).Encode(struct {
+		Challenge  string `json:"challenge"`
+		Difficulty int    `json:"difficulty"`
+		Expires    int64  `json:"expires"`
+	}{
+		Challenge:  challenge,
+		Difficulty: difficulty,
+		Expires:    expires.Unix(),
+	})
+
+	if err != nil {
+		log.Println("error writing response. Details:", err)
+	}
+}
+
+// leadingZeroBits counts the zero bits in the beginning of the data.
+func leadingZeroBits(data []byte) int {
+	count := 0
+	for _, b := range data {
+		if b != 0 {
+			return count + bits.LeadingZeros8(b)
+		}
+		count += 8
+	}
+	return count
+}
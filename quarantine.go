@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// moderationPath is where the moderators approve or reject the held
+// submissions, followed by the submission identifier.
+const moderationPath = "/moderation/"
+
+// Actions of the moderators
+const (
+	moderationApprove = "approve"
+	moderationReject  = "reject"
+)
+
+// moderationLabels describes the actions in the confirmation page.
+var moderationLabels = map[string]string{
+	moderationApprove: "Approve",
+	moderationReject:  "Reject",
+}
+
+// moderationResults describes the held submissions after the actions.
+var moderationResults = map[string]string{
+	moderationApprove: "approved",
+	moderationReject:  "rejected",
+}
+
+// knownSendersFile stores the hashes of the senders already delivered, inside
+// the quarantine directory.
+const knownSendersFile = "senders"
+
+// errNotHeld is returned when the submission was already reviewed or expired.
+var errNotHeld = errors.New("submission not held")
+
+// quarantineConfig stores when the submissions are held until a moderator
+// approves them, instead of being delivered: the spam score, senders that
+// never sent an e-mail before and blocked words. When none of them is set the
+// submissions are never held.
+type quarantineConfig struct {
+	Score      float64
+	NewSenders bool `yaml:"new senders"`
+	Words      stringList
+	Moderators stringList
+	Directory  string
+	Expires    time.Duration
+	Token      string
+
+	// Parsed moderators
+	moderators []*mail.Address
+}
+
+// quarantineItem is a held submission stored in the quarantine directory. The
+// attachments are stored next to it, with the position in the name.
+type quarantineItem struct {
+	Form       string     `json:"form"`
+	IP         string     `json:"ip"`
+	Reasons    []string   `json:"reasons"`
+	Created    time.Time  `json:"created"`
+	Expires    time.Time  `json:"expires"`
+	Submission submission `json:"submission"`
+}
+
+// knownSenders stores the hashes of the senders already delivered, so the
+// e-mail addresses aren't kept in clear text.
+var knownSenders = struct {
+	sync.Mutex
+	hashes map[string]bool
+}{}
+
+// enabled checks if the submissions can be held.
+func (q quarantineConfig) enabled() bool {
+	return q.Score > 0 || q.NewSenders || len(q.Words) > 0
+}
+
+// prepare parses the moderators. The directory is only created when the
+// service starts.
+func (q *quarantineConfig) prepare() error {
+	var err error
+	if q.moderators, err = parseAddressList(q.Moderators); err != nil {
+		return fmt.Errorf("invalid moderators. Details: %s", err)
+	}
+	return nil
+}
+
+// reasons returns why the submission must be held, or nothing when it can be
+// delivered.
+func (q quarantineConfig) reasons(input submission) []string {
+	var reasons []string
+
+	if q.Score > 0 && input.Spam != nil && input.Spam.Score >= q.Score {
+		reasons = append(reasons, fmt.Sprintf("spam score %.1f", input.Spam.Score))
+	}
+
+	if len(q.Words) > 0 {
+		var content []string
+		for _, value := range input.Fields {
+			content = append(content, value)
+		}
+		lowerContent := strings.ToLower(strings.Join(content, "\n"))
+
+		for _, word := range q.Words {
+			if word = strings.ToLower(strings.TrimSpace(word)); word != "" && strings.Contains(lowerContent, word) {
+				reasons = append(reasons, fmt.Sprintf("blocked word “%s”", word))
+			}
+		}
+	}
+
+	if q.NewSenders && input.Email != "" && !knownSender(input.Email) {
+		reasons = append(reasons, "new sender")
+	}
+
+	return reasons
+}
+
+// senderHash identifies the sender without the e-mail address.
+func senderHash(email string) string {
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(hash[:])
+}
+
+// loadKnownSenders reads the hashes of the senders already delivered, one per
+// line.
+func loadKnownSenders() error {
+	hashes := make(map[string]bool)
+
+	file, err := os.Open(filepath.Join(config.Quarantine.Directory, knownSendersFile))
+	if os.IsNotExist(err) {
+		knownSenders.Lock()
+		knownSenders.hashes = hashes
+		knownSenders.Unlock()
+		return nil
+
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			hashes[line] = true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	knownSenders.Lock()
+	knownSenders.hashes = hashes
+	knownSenders.Unlock()
+	return nil
+}
+
+func knownSender(email string) bool {
+	knownSenders.Lock()
+	defer knownSenders.Unlock()
+
+	return knownSenders.hashes[senderHash(email)]
+}
+
+// addKnownSender remembers the sender of a delivered submission, so the next
+// submissions aren't held as from a new sender.
+func addKnownSender(email string) {
+	if email == "" {
+		return
+	}
+
+	hash := senderHash(email)
+
+	knownSenders.Lock()
+	defer knownSenders.Unlock()
+
+	if knownSenders.hashes[hash] {
+		return
+	}
+
+	path := filepath.Join(config.Quarantine.Directory, knownSendersFile)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("error opening known senders “%s”. Details: %s", path, err)
+		return
+	}
+	defer file.Close()
+
+	if _, err := fmt.Fprintln(file, hash); err != nil {
+		log.Printf("error writing known senders “%s”. Details: %s", path, err)
+		return
+	}
+
+	knownSenders.hashes[hash] = true
+}
+
+// quarantinePath returns where the held submission is stored.
+func quarantinePath(id string) string {
+	return filepath.Join(config.Quarantine.Directory, id+".json")
+}
+
+// quarantineAttachmentPath returns where the attachment of the held
+// submission is stored.
+func quarantineAttachmentPath(id string, i int) string {
+	return filepath.Join(config.Quarantine.Directory, id+"."+strconv.Itoa(i))
+}
+
+// hold stores the submission in the quarantine directory and notifies the
+// moderators with the links to approve or reject it.
+func (f *form) hold(input submission, ip string, reasons []string) error {
+	now := time.Now()
+	item := quarantineItem{
+		Form:       f.ID,
+		IP:         ip,
+		Reasons:    reasons,
+		Created:    now,
+		Expires:    now.Add(config.Quarantine.Expires),
+		Submission: input,
+	}
+
+	for i, a := range input.Attachments {
+		if err := copyFile(a.Path, quarantineAttachmentPath(input.ID, i)); err != nil {
+			removeQuarantined(input.ID)
+			return fmt.Errorf("error storing attachment. Details: %s", err)
+		}
+	}
+
+	content, err := json.Marshal(item)
+	if err != nil {
+		removeQuarantined(input.ID)
+		return err
+	}
+
+	if err := os.WriteFile(quarantinePath(input.ID), content, 0600); err != nil {
+		removeQuarantined(input.ID)
+		return err
+	}
+
+	if err := f.notifyModerators(item); err != nil {
+		removeQuarantined(input.ID)
+		return fmt.Errorf("error notifying moderators. Details: %s", err)
+	}
+
+	return nil
+}
+
+// moderationLinks returns the signed links to approve or reject the held
+// submission.
+func moderationLinks(item quarantineItem) map[string]string {
+	expires := strconv.FormatInt(item.Expires.Unix(), 10)
+
+	links := make(map[string]string)
+	for _, action := range []string{moderationApprove, moderationReject} {
+		query := make(url.Values)
+		query.Set("action", action)
+		query.Set("expires", expires)
+		query.Set("signature", sign("moderation", item.Submission.ID, action, expires))
+
+		links[action] = strings.TrimRight(config.URL, "/") + moderationPath + item.Submission.ID + "?" + query.Encode()
+	}
+	return links
+}
+
+// notifyModerators sends the held submission to the moderators, or to the
+// form mailbox when there are no moderators.
+func (f *form) notifyModerators(item quarantineItem) error {
+	var recipients []string
+	header := map[string]string{
+		"Subject":                   "Submission held for moderation: " + item.Submission.Subject,
+		"MIME-Version":              "1.0",
+		"Content-Type":              `text/plain; charset="utf-8"`,
+		"Content-Transfer-Encoding": "base64",
+	}
+
+	if len(config.Quarantine.moderators) > 0 {
+		header["To"] = formatAddressList(config.Quarantine.moderators)
+		for _, address := range config.Quarantine.moderators {
+			recipients = append(recipients, address.Address)
+		}
+
+	} else {
+		for key, value := range f.Mailbox.header() {
+			header[key] = value
+		}
+		recipients = f.Mailbox.recipients()
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	header["Message-ID"] = fmt.Sprintf("<moderation.%s@%s>", item.Submission.ID, hostname)
+	header["From"] = recipients[0]
+
+	input := item.Submission
+	links := moderationLinks(item)
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "A submission to the form “%s” was held for moderation: %s.\n", item.Form, strings.Join(item.Reasons, ", "))
+	fmt.Fprintf(&body, "It is removed on %s when not reviewed.\n\n", item.Expires.Format(time.RFC1123))
+	fmt.Fprintf(&body, "Client: %s <%s> (%s)\nSubject: %s\n", input.Name, input.Email, item.IP, input.Subject)
+	fmt.Fprintf(&body, "-------------------------------------\n%s\n-------------------------------------\n", input.Message)
+
+	if len(input.Attachments) > 0 {
+		body.WriteString("\nAttachments:\n")
+		for _, a := range input.Attachments {
+			fmt.Fprintf(&body, "%s (%s)\n", a.Filename, byteSize(a.Size))
+		}
+	}
+
+	fmt.Fprintf(&body, "\nApprove: %s\nReject: %s\n", links[moderationApprove], links[moderationReject])
+
+	var message bytes.Buffer
+	for key, value := range header {
+		message.WriteString(fmt.Sprintf("%s: %s\r\n", key, value))
+	}
+	message.WriteString("\r\n")
+
+	encoder := base64.NewEncoder(base64.StdEncoding, &lineWrapper{w: &message})
+	encoder.Write(body.Bytes())
+	encoder.Close()
+
+	return deliveryTransport.send(recipients[0], recipients, rawMessage(message.Bytes()))
+}
+
+// readQuarantined reads the held submission.
+func readQuarantined(path string) (quarantineItem, error) {
+	var item quarantineItem
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return item, err
+	}
+
+	err = json.Unmarshal(content, &item)
+	return item, err
+}
+
+// moderate approves or rejects the held submission. The approved submissions
+// are delivered, and when the delivery fails the submission is held again so
+// it can be retried.
+func moderate(id, action string) error {
+	path := quarantinePath(id)
+
+	// the submission is renamed first, so concurrent requests don't deliver
+	// it twice
+	processingPath := path + ".processing"
+	if err := os.Rename(path, processingPath); os.IsNotExist(err) {
+		return errNotHeld
+	} else if err != nil {
+		return err
+	}
+
+	item, err := readQuarantined(processingPath)
+	if err != nil {
+		os.Rename(processingPath, path)
+		return err
+	}
+
+	if action == moderationApprove {
+		var f *form
+		if item.Form != "" {
+			f = findForm(item.Form)
+		}
+
+		if f == nil {
+			os.Rename(processingPath, path)
+			return fmt.Errorf("unknown form “%s”", item.Form)
+		}
+
+		input := item.Submission
+		for i := range input.Attachments {
+			input.Attachments[i].Path = quarantineAttachmentPath(id, i)
+		}
+
+		if err := f.deliver(input); err != nil {
+			os.Rename(processingPath, path)
+			archiveStatus(id, archiveStatusHeld, err.Error())
+			return err
+		}
+		archiveStatus(id, archiveStatusSent, "")
+
+	} else {
+		archiveStatus(id, archiveStatusRejected, "rejected by moderator")
+	}
+
+	removeQuarantined(id)
+	log.Printf("held submission “%s” %s", id, moderationResults[action])
+	return nil
+}
+
+// removeQuarantined removes the held submission and its attachments.
+func removeQuarantined(id string) {
+	paths, _ := filepath.Glob(filepath.Join(config.Quarantine.Directory, id+".*"))
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("error removing held submission “%s”. Details: %s", path, err)
+		}
+	}
+}
+
+// removeExpiredQuarantine removes the held submissions that weren't reviewed
+// in time.
+func removeExpiredQuarantine() {
+	if !config.Quarantine.enabled() {
+		return
+	}
+
+	entries, err := os.ReadDir(config.Quarantine.Directory)
+	if err != nil {
+		log.Printf("error reading quarantine directory “%s”. Details: %s", config.Quarantine.Directory, err)
+		return
+	}
+
+	for _, entry := range entries {
+		id := strings.SplitN(entry.Name(), ".", 2)[0]
+		if !submissionIDFormat.MatchString(id) || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) <= config.Quarantine.Expires {
+			continue
+		}
+
+		log.Printf("held submission “%s” expired without review", id)
+		archiveStatus(id, archiveStatusExpired, "expired without review")
+		removeQuarantined(id)
+	}
+}
+
+// listQuarantined returns the held submissions, the oldest first.
+func listQuarantined() ([]quarantineItem, error) {
+	paths, err := filepath.Glob(filepath.Join(config.Quarantine.Directory, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	items := []quarantineItem{}
+	for _, path := range paths {
+		item, err := readQuarantined(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Created.Before(items[j].Created)
+	})
+	return items, nil
+}
+
+// handleModeration approves or rejects the held submissions. The moderators
+// use the signed links of the notification, that first show a confirmation
+// page as the feedback links, or the admin API with the token in the
+// "Authorization: Bearer" header.
+func handleModeration(w http.ResponseWriter, r *http.Request) {
+	if !config.Quarantine.enabled() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, moderationPath)
+	if id != "" && !submissionIDFormat.MatchString(id) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.Header.Get("Authorization") != "" {
+		handleModerationAPI(w, r, id)
+		return
+	}
+
+	query := r.URL.Query()
+	action, expires := query.Get("action"), query.Get("expires")
+	if id == "" || (action != moderationApprove && action != moderationReject) ||
+		!validSignature(query.Get("signature"), "moderation", id, action, expires) {
+
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if expiresAt, err := strconv.ParseInt(expires, 10, 64); err != nil || time.Now().Unix() > expiresAt {
+		feedbackPage(w, http.StatusGone, "This link expired.")
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		feedbackPage(w, http.StatusOK, fmt.Sprintf(`%s the submission?
+<form method="post" action="%s"><button type="submit">Confirm</button></form>`,
+			moderationLabels[action], html.EscapeString(r.URL.RequestURI())))
+		return
+
+	case "POST":
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := moderate(id, action); errors.Is(err, errNotHeld) {
+		feedbackPage(w, http.StatusGone, "This submission was already reviewed or expired.")
+		return
+
+	} else if err != nil {
+		log.Printf("error moderating submission “%s”. Details: %s", id, err)
+		feedbackPage(w, http.StatusInternalServerError, "Something went wrong, try again later.")
+		return
+	}
+
+	feedbackPage(w, http.StatusOK, fmt.Sprintf("Thanks, the submission was %s.", moderationResults[action]))
+}
+
+// handleModerationAPI lists the held submissions (GET on the moderation
+// path), shows one (GET with the identifier) or approves and rejects it (POST
+// with the identifier and the action in the query string).
+func handleModerationAPI(w http.ResponseWriter, r *http.Request, id string) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if config.Quarantine.Token == "" || !hmac.Equal([]byte(token), []byte(config.Quarantine.Token)) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var body interface{}
+
+	switch {
+	case r.Method == "GET" && id == "":
+		items, err := listQuarantined()
+		if err != nil {
+			log.Println("error listing held submissions. Details:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body = items
+
+	case r.Method == "GET":
+		item, err := readQuarantined(quarantinePath(id))
+		if os.IsNotExist(err) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+
+		} else if err != nil {
+			log.Printf("error reading held submission “%s”. Details: %s", id, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body = item
+
+	case r.Method == "POST" && id != "":
+		action := r.URL.Query().Get("action")
+		if action != moderationApprove && action != moderationReject {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err := moderate(id, action); errors.Is(err, errNotHeld) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+
+		} else if err != nil {
+			log.Printf("error moderating submission “%s”. Details: %s", id, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body = map[string]string{"id": id, "status": moderationResults[action]}
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Println("error writing response. Details:", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// redirectNextField is the hidden field that HTML forms can use to choose the
+// page shown after the e-mail is sent.
+const redirectNextField = "_next"
+
+// redirectConfig stores where the clients without JavaScript are sent after
+// posting a HTML form.
+type redirectConfig struct {
+	SuccessURL   string     `yaml:"success url"`
+	ErrorURL     string     `yaml:"error url"`
+	AllowedHosts stringList `yaml:"allowed hosts"`
+}
+
+// validate checks if the redirect URLs are well formed.
+func (r redirectConfig) validate() error {
+	for _, rawURL := range []string{r.SuccessURL, r.ErrorURL} {
+		if rawURL == "" {
+			continue
+		}
+
+		if _, err := url.Parse(rawURL); err != nil {
+			return fmt.Errorf("invalid redirect URL “%s”. Details: %s", rawURL, err)
+		}
+	}
+	return nil
+}
+
+// successURL returns the page shown after the e-mail is sent. The "_next"
+// field replaces the configured URL when its host is allowed.
+func (f *form) successURL(r *http.Request) string {
+	next := strings.TrimSpace(r.FormValue(redirectNextField))
+	if next == "" {
+		return f.Redirect.SuccessURL
+	}
+
+	nextURL, err := url.Parse(next)
+	if err != nil || !nextURL.IsAbs() || (nextURL.Scheme != "http" && nextURL.Scheme != "https") {
+		log.Printf("invalid redirect URL “%s” in form “%s”", next, f.ID)
+		return f.Redirect.SuccessURL
+	}
+
+	host := strings.ToLower(nextURL.Hostname())
+	for _, pattern := range f.Redirect.AllowedHosts {
+		if matchDomain(host, strings.ToLower(pattern)) {
+			return next
+		}
+	}
+
+	log.Printf("redirect host “%s” not allowed in form “%s”", host, f.ID)
+	return f.Redirect.SuccessURL
+}
+
+// redirect sends the client to the page with the result in the query string
+// (status, id, code and the invalid fields).
+func redirect(w http.ResponseWriter, r *http.Request, redirectTo string, body response) {
+	redirectURL, err := url.Parse(redirectTo)
+	if err != nil {
+		log.Printf("invalid redirect URL “%s”. Details: %s", redirectTo, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	query := redirectURL.Query()
+	query.Set("status", body.Status)
+
+	if body.ID != "" {
+		query.Set("id", body.ID)
+	}
+
+	if body.Error != nil {
+		query.Set("code", body.Error.Code)
+
+		if len(body.Error.Fields) > 0 {
+			var fields []string
+			for field := range body.Error.Fields {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+			query.Set("fields", strings.Join(fields, ","))
+		}
+	}
+
+	if suggestion := body.Suggestions["email"]; suggestion != "" {
+		query.Set("suggestion", suggestion)
+	}
+
+	redirectURL.RawQuery = query.Encode()
+	http.Redirect(w, r, redirectURL.String(), http.StatusSeeOther)
+}
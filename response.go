@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// maxFormValuesSize limits the size of the form values sent in a JSON body or
+// in the text fields of a multipart body, the same limit used by the standard
+// library for form-encoded bodies.
+const maxFormValuesSize = 10 << 20
+
+// Machine-readable error codes of the JSON responses
+const (
+	errCodeMethodNotAllowed      = "method_not_allowed"
+	errCodeOriginNotAllowed      = "origin_not_allowed"
+	errCodeRateLimited           = "rate_limited"
+	errCodeInvalidInput          = "invalid_input"
+	errCodeIdempotencyKeyReused  = "idempotency_key_reused"
+	errCodeScannerUnavailable    = "scanner_unavailable"
+	errCodeCaptchaFailed         = "captcha_failed"
+	errCodeCaptchaUnavailable    = "captcha_unavailable"
+	errCodeChallengeFailed       = "challenge_failed"
+	errCodeSpam                  = "spam"
+	errCodeEmailNotAllowed       = "email_not_allowed"
+	errCodeEmailCheckUnavailable = "email_check_unavailable"
+	errCodeIPBlocked             = "ip_blocked"
+	errCodeBlocklistUnavailable  = "blocklist_unavailable"
+	errCodeInternal              = "internal_error"
+)
+
+// errMessages describes the error codes to humans.
+var errMessages = map[string]string{
+	errCodeMethodNotAllowed:      "only POST requests are allowed",
+	errCodeOriginNotAllowed:      "origin not allowed",
+	errCodeRateLimited:           "too many e-mails sent, try again later",
+	errCodeInvalidInput:          "invalid input",
+	errCodeIdempotencyKeyReused:  "idempotency key already used with another submission",
+	errCodeScannerUnavailable:    "attachments can't be checked now, try again later",
+	errCodeCaptchaFailed:         "CAPTCHA verification failed",
+	errCodeCaptchaUnavailable:    "CAPTCHA can't be verified now, try again later",
+	errCodeChallengeFailed:       "proof-of-work challenge failed",
+	errCodeSpam:                  "message rejected as spam",
+	errCodeEmailNotAllowed:       "e-mail address not allowed, use another address",
+	errCodeEmailCheckUnavailable: "e-mail address can't be checked now, try again later",
+	errCodeIPBlocked:             "client address blocked",
+	errCodeBlocklistUnavailable:  "client address can't be checked now, try again later",
+	errCodeInternal:              "something went wrong, try again later",
+}
+
+// response is the body of the JSON responses.
+type response struct {
+	Status string         `json:"status"`
+	ID     string         `json:"id,omitempty"`
+	Error  *responseError `json:"error,omitempty"`
+
+	// Suggestions are the values that the client probably meant, like the
+	// e-mail address without typos. They never block the submission.
+	Suggestions map[string]string `json:"suggestions,omitempty"`
+}
+
+type responseError struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// validationError stores the problem found in each field of the submission.
+type validationError map[string]string
+
+func (v validationError) Error() string {
+	var fields []string
+	for field, message := range v {
+		fields = append(fields, field+": "+message)
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, "; ")
+}
+
+// wantsJSON checks if the client accepts a JSON response. Legacy clients only
+// receive the status code with an empty body, or are redirected when the form
+// has redirect URLs.
+func wantsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(accept)
+		if err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) {
+			return true
+		}
+	}
+	return false
+}
+
+// replySuccess answers that the e-mail was sent, suggesting fixes for the
+// e-mail address typos.
+func (f *form) replySuccess(w http.ResponseWriter, r *http.Request, id string) {
+	reply(w, r, http.StatusOK, response{
+		Status:      "sent",
+		ID:          id,
+		Suggestions: emailSuggestions(r),
+	}, f.successURL(r))
+}
+
+// replyHeld answers that the submission was accepted, but it's only sent
+// after a moderator approves it.
+func (f *form) replyHeld(w http.ResponseWriter, r *http.Request, id string) {
+	reply(w, r, http.StatusAccepted, response{
+		Status:      "held",
+		ID:          id,
+		Suggestions: emailSuggestions(r),
+	}, f.successURL(r))
+}
+
+// replyError answers with the error code. The fields are only used for
+// validation errors.
+func (f *form) replyError(w http.ResponseWriter, r *http.Request, status int, code string, fields map[string]string) {
+	reply(w, r, status, response{
+		Status: "error",
+		Error: &responseError{
+			Code:    code,
+			Message: errMessages[code],
+			Fields:  fields,
+		},
+	}, f.Redirect.ErrorURL)
+}
+
+// replyInvalid answers with a validation error, suggesting fixes for the
+// e-mail address typos.
+func (f *form) replyInvalid(w http.ResponseWriter, r *http.Request, code string, fields map[string]string) {
+	reply(w, r, http.StatusBadRequest, response{
+		Status: "error",
+		Error: &responseError{
+			Code:    code,
+			Message: errMessages[code],
+			Fields:  fields,
+		},
+		Suggestions: emailSuggestions(r),
+	}, f.Redirect.ErrorURL)
+}
+
+func reply(w http.ResponseWriter, r *http.Request, status int, body response, redirectTo string) {
+	if !wantsJSON(r) {
+		if redirectTo != "" {
+			redirect(w, r, redirectTo, body)
+			return
+		}
+
+		w.WriteHeader(status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Println("error writing response. Details:", err)
+	}
+}
+
+// readJSONBody converts a JSON object in the request body to form values, so
+// the fields can be read in the same way of a form-encoded body.
+func readJSONBody(r *http.Request) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return nil
+	}
+
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxFormValuesSize))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return validationError{"body": "invalid JSON object"}
+	}
+
+	values := make(url.Values)
+	for field, value := range fields {
+		switch v := value.(type) {
+		case nil:
+		case string:
+			values.Set(field, v)
+		case []interface{}:
+			for _, item := range v {
+				values.Add(field, fmt.Sprint(item))
+			}
+		default:
+			values.Set(field, fmt.Sprint(v))
+		}
+	}
+
+	r.Form = values
+	r.PostForm = values
+	return nil
+}
+
+// submissionIDFormat matches the identifiers generated by newSubmissionID.
+var submissionIDFormat = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// newSubmissionID generates a random identifier for the submission, also used
+// in the e-mail Message-ID header.
+func newSubmissionID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
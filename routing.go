@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/rafaeljusto/contactme/Godeps/_workspace/src/github.com/codegangsta/cli"
+)
+
+// route sends the e-mails that match its conditions to different recipients,
+// with a different template or subject prefix.
+type route struct {
+	Name string
+	When struct {
+		SubjectContains stringList `yaml:"subject contains"`
+		Fields          map[string]stringList
+		Domain          stringList
+		Language        stringList
+	}
+	Mailbox mailbox
+	Email   emailConfig
+
+	// Parsed template
+	emailTemplate *template.Template
+}
+
+// match checks if the submission satisfies all the conditions of the route.
+// When a condition has many values, any of them can match.
+func (r route) match(input submission) bool {
+	if len(r.When.SubjectContains) > 0 {
+		subject := strings.ToLower(input.Subject)
+
+		found := false
+		for _, text := range r.When.SubjectContains {
+			if strings.Contains(subject, strings.ToLower(text)) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	for field, values := range r.When.Fields {
+		found := false
+		for _, value := range values {
+			if strings.EqualFold(input.Fields[field], value) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.When.Domain) > 0 {
+		domain := strings.ToLower(input.Email[strings.LastIndex(input.Email, "@")+1:])
+
+		found := false
+		for _, pattern := range r.When.Domain {
+			if matchDomain(domain, strings.ToLower(pattern)) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.When.Language) > 0 {
+		found := false
+		for _, language := range r.When.Language {
+			language = strings.ToLower(language)
+			if input.Language == language || strings.HasPrefix(input.Language, language+"-") {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchDomain compares the domain with a pattern that can be an exact domain
+// or a wildcard for the subdomains (e.g. *.example.com).
+func matchDomain(domain, pattern string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(domain, pattern[1:])
+	}
+	return domain == pattern
+}
+
+func (r *route) prepare() error {
+	if err := r.Mailbox.parse(); err != nil {
+		return err
+	}
+
+	var err error
+	r.emailTemplate, err = template.New("ContactMe E-mail").Parse(r.Email.Template)
+	return err
+}
+
+// routeCommand shows the route that a sample submission would take, without
+// sending any e-mail.
+var routeCommand = cli.Command{
+	Name:  "route",
+	Usage: "Show which route a sample submission would take",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "form",
+			Usage: "Identifier of the form (default: main form)",
+		},
+		cli.StringFlag{
+			Name:  "email",
+			Usage: "Client e-mail",
+		},
+		cli.StringFlag{
+			Name:  "subject",
+			Usage: "Subject of the client",
+		},
+		cli.StringFlag{
+			Name:  "language",
+			Usage: "Language of the client (e.g. pt-BR)",
+		},
+		cli.StringSliceFlag{
+			Name:  "field",
+			Value: &cli.StringSlice{},
+			Usage: "Other field of the submission in the format name=value",
+		},
+	},
+	Action: func(c *cli.Context) {
+		readCommandLineInputs(c)
+		fillConfigurationDefaults()
+		validateConfiguration()
+
+		input := submission{
+			Email:    c.String("email"),
+			Subject:  c.String("subject"),
+			Language: strings.ToLower(c.String("language")),
+			Fields:   make(map[string]string),
+		}
+
+		for _, field := range c.StringSlice("field") {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				fmt.Printf("invalid field “%s”, expected name=value\n", field)
+				os.Exit(errMissingParameters)
+			}
+			input.Fields[parts[0]] = parts[1]
+		}
+
+		f := findForm(c.String("form"))
+		if f == nil {
+			fmt.Printf("form “%s” not found\n", c.String("form"))
+			os.Exit(errMissingParameters)
+		}
+
+		r := f.findRoute(input)
+		fmt.Printf("Form:    %s (%s)\n", f.ID, f.Path)
+		fmt.Printf("Route:   %s\n", r.Name)
+		fmt.Printf("To:      %s\n", formatAddressList(r.Mailbox.to))
+		fmt.Printf("Cc:      %s\n", formatAddressList(r.Mailbox.cc))
+		fmt.Printf("Bcc:     %s\n", formatAddressList(r.Mailbox.bcc))
+		fmt.Printf("Subject: %s\n", r.Email.SubjectPrefix+input.Subject)
+	},
+}
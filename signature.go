@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// prepareSecret uses the configured secret to sign links and tokens, or a
+// random one when it is empty. A random secret is lost on restart, so the links
+// already sent stop working.
+func prepareSecret() error {
+	if config.Secret != "" {
+		secret = []byte(config.Secret)
+		return nil
+	}
+
+	secret = make([]byte, 32)
+	_, err := rand.Read(secret)
+	return err
+}
+
+// sign generates a signature of the parts with the service secret.
+func sign(parts ...string) string {
+	mac := hmac.New(sha256.New, secret)
+	for i, part := range parts {
+		if i > 0 {
+			mac.Write([]byte{0})
+		}
+		mac.Write([]byte(part))
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validSignature checks if the signature was generated with the service secret
+// for the parts.
+func validSignature(signature string, parts ...string) bool {
+	return hmac.Equal([]byte(signature), []byte(sign(parts...)))
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultSpamTag is added to the subject of the e-mails that may be spam.
+const defaultSpamTag = "[SPAM?] "
+
+var linkFormat = regexp.MustCompile(`(?i)(https?://|www\.)`)
+
+// spamConfig stores the rules that score the submission content and the
+// scores where the submission is tagged or rejected.
+type spamConfig struct {
+	RejectScore float64 `yaml:"reject score"`
+	TagScore    float64 `yaml:"tag score"`
+	Tag         string
+	Rules       spamRules
+
+	// Rules with score
+	rules []spamRule
+}
+
+// spamRules stores the settings of each rule. A rule is only used when it has
+// a score.
+type spamRules struct {
+	Links              linksRule
+	Keywords           keywordsRule
+	CapsRatio          capsRatioRule      `yaml:"caps ratio"`
+	SuspiciousTLDs     suspiciousTLDsRule `yaml:"suspicious tlds"`
+	Length             lengthRule
+	RepeatedCharacters repeatedCharactersRule `yaml:"repeated characters"`
+}
+
+// spamRule checks one characteristic of the submission, returning the score
+// when the submission looks like spam.
+type spamRule interface {
+	name() string
+	check(input submission) float64
+}
+
+// spamResult is the score of the submission, with the score of each rule.
+type spamResult struct {
+	Score   float64  `json:"score"`
+	Details []string `json:"details,omitempty"`
+	Tag     string   `json:"tag,omitempty"`
+}
+
+// enabled checks if the submissions are scored.
+func (s spamConfig) enabled() bool {
+	return s.RejectScore > 0 || s.TagScore > 0
+}
+
+// prepare parses the rules and keeps the ones with score.
+func (s *spamConfig) prepare() error {
+	if s.Tag == "" {
+		s.Tag = defaultSpamTag
+	}
+
+	if err := s.Rules.Keywords.prepare(); err != nil {
+		return err
+	}
+
+	s.rules = nil
+	for _, rule := range []struct {
+		spamRule
+		score float64
+	}{
+		{s.Rules.Links, s.Rules.Links.Score},
+		{s.Rules.Keywords, s.Rules.Keywords.Score},
+		{s.Rules.CapsRatio, s.Rules.CapsRatio.Score},
+		{s.Rules.SuspiciousTLDs, s.Rules.SuspiciousTLDs.Score},
+		{s.Rules.Length, s.Rules.Length.Score},
+		{s.Rules.RepeatedCharacters, s.Rules.RepeatedCharacters.Score},
+	} {
+		if rule.score > 0 {
+			s.rules = append(s.rules, rule.spamRule)
+		}
+	}
+
+	// depends on the configuration instead of the loaded classifier, so the
+	// rule isn't lost when the classifier is loaded after the forms
+	if config.Bayes.File != "" {
+		s.rules = append(s.rules, bayesRule{Weight: config.Bayes.Weight})
+	}
+
+	return nil
+}
+
+// evaluate runs all the rules, adding their scores.
+func (s spamConfig) evaluate(input submission) *spamResult {
+	result := new(spamResult)
+	for _, rule := range s.rules {
+		if score := rule.check(input); score > 0 {
+			result.Score += score
+			result.Details = append(result.Details, fmt.Sprintf("%s=%.1f", rule.name(), score))
+		}
+	}
+
+	if s.TagScore > 0 && result.Score >= s.TagScore {
+		result.Tag = s.Tag
+	}
+
+	return result
+}
+
+// rejected checks if the score is high enough to reject the submission.
+func (s spamConfig) rejected(result *spamResult) bool {
+	return s.RejectScore > 0 && result.Score >= s.RejectScore
+}
+
+// String describes the score for the e-mail header.
+func (s spamResult) String() string {
+	if len(s.Details) == 0 {
+		return fmt.Sprintf("%.1f", s.Score)
+	}
+	return fmt.Sprintf("%.1f (%s)", s.Score, strings.Join(s.Details, ", "))
+}
+
+// linksRule scores each link above the maximum.
+type linksRule struct {
+	Max   int
+	Score float64
+}
+
+func (l linksRule) name() string {
+	return "links"
+}
+
+func (l linksRule) check(input submission) float64 {
+	links := len(linkFormat.FindAllString(input.Subject+" "+input.Message, -1))
+	if links <= l.Max {
+		return 0
+	}
+	return float64(links-l.Max) * l.Score
+}
+
+// keywordsRule scores each blocked word or regular expression found in the
+// subject or message. The words are case insensitive.
+type keywordsRule struct {
+	Words    stringList
+	Patterns stringList
+	Score    float64
+
+	// Parsed patterns
+	patterns []*regexp.Regexp
+}
+
+func (k *keywordsRule) prepare() error {
+	k.patterns = nil
+	for _, pattern := range k.Patterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid spam pattern “%s”. Details: %s", pattern, err)
+		}
+		k.patterns = append(k.patterns, compiled)
+	}
+	return nil
+}
+
+func (k keywordsRule) name() string {
+	return "keywords"
+}
+
+func (k keywordsRule) check(input submission) float64 {
+	content := input.Subject + "\n" + input.Message
+	lowerContent := strings.ToLower(content)
+
+	var score float64
+	for _, word := range k.Words {
+		if word != "" && strings.Contains(lowerContent, strings.ToLower(word)) {
+			score += k.Score
+		}
+	}
+
+	for _, pattern := range k.patterns {
+		if pattern.MatchString(content) {
+			score += k.Score
+		}
+	}
+
+	return score
+}
+
+// capsRatioRule scores messages written mostly in capital letters. Short
+// messages are ignored.
+type capsRatioRule struct {
+	Max       float64
+	MinLength int `yaml:"min length"`
+	Score     float64
+}
+
+func (c capsRatioRule) name() string {
+	return "caps ratio"
+}
+
+func (c capsRatioRule) check(input submission) float64 {
+	var letters, upper int
+	for _, r := range input.Message {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+
+	if letters == 0 || letters < c.MinLength || float64(upper)/float64(letters) <= c.Max {
+		return 0
+	}
+	return c.Score
+}
+
+// suspiciousTLDsRule scores senders from top level domains commonly used by
+// spammers.
+type suspiciousTLDsRule struct {
+	List  stringList
+	Score float64
+}
+
+func (s suspiciousTLDsRule) name() string {
+	return "suspicious tld"
+}
+
+func (s suspiciousTLDsRule) check(input submission) float64 {
+	domain := strings.ToLower(input.Email[strings.LastIndex(input.Email, "@")+1:])
+	for _, tld := range s.List {
+		tld = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tld), "."))
+		if tld != "" && strings.HasSuffix(domain, "."+tld) {
+			return s.Score
+		}
+	}
+	return 0
+}
+
+// lengthRule scores messages too short or too long.
+type lengthRule struct {
+	Min   int
+	Max   int
+	Score float64
+}
+
+func (l lengthRule) name() string {
+	return "length"
+}
+
+func (l lengthRule) check(input submission) float64 {
+	length := utf8.RuneCountInString(strings.TrimSpace(input.Message))
+	if length < l.Min || (l.Max > 0 && length > l.Max) {
+		return l.Score
+	}
+	return 0
+}
+
+// repeatedCharactersRule scores messages with the same character repeated
+// many times in a row (e.g. "!!!!!!!!").
+type repeatedCharactersRule struct {
+	Max   int
+	Score float64
+}
+
+func (r repeatedCharactersRule) name() string {
+	return "repeated characters"
+}
+
+func (r repeatedCharactersRule) check(input submission) float64 {
+	var last rune
+	count := 0
+	for _, c := range input.Subject + "\n" + input.Message {
+		if c == last {
+			count++
+		} else {
+			last, count = c, 1
+		}
+
+		if r.Max > 0 && count > r.Max && !unicode.IsSpace(c) {
+			return r.Score
+		}
+	}
+	return 0
+}
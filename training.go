@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/rafaeljusto/contactme/Godeps/_workspace/src/github.com/codegangsta/cli"
+)
+
+// mboxFromQuote matches the quoted "From " lines of a mboxrd message.
+var mboxFromQuote = regexp.MustCompile(`(?m)^>(>*From )`)
+
+var trainCommand = cli.Command{
+	Name:  "train",
+	Usage: "Train the spam classifier with labelled messages (mbox or eml files, or directories of eml files)",
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "spam",
+			Value: &cli.StringSlice{},
+			Usage: "Path of spam messages",
+		},
+		cli.StringSliceFlag{
+			Name:  "ham",
+			Value: &cli.StringSlice{},
+			Usage: "Path of legitimate messages",
+		},
+	},
+	Action: func(c *cli.Context) {
+		readCommandLineInputs(c)
+		fillConfigurationDefaults()
+
+		if config.Bayes.File == "" {
+			fmt.Println("missing “bayes” file in the configuration")
+			os.Exit(errMissingParameters)
+		}
+
+		var err error
+		if classifier, err = loadClassifier(config.Bayes.File); err != nil {
+			fmt.Printf("error loading spam classifier. Details: %s\n", err)
+			os.Exit(errLoadingClassifier)
+		}
+
+		for _, label := range []string{bayesLabelSpam, bayesLabelHam} {
+			count := 0
+			for _, path := range c.StringSlice(label) {
+				messages, err := readMessages(path)
+				if err != nil {
+					fmt.Printf("error reading messages from “%s”. Details: %s\n", path, err)
+					os.Exit(errLoadingClassifier)
+				}
+
+				for _, message := range messages {
+					classifier.train(messageText(message), label == bayesLabelSpam)
+				}
+				count += len(messages)
+			}
+			fmt.Printf("%s messages learned: %d\n", label, count)
+		}
+
+		if err := classifier.save(); err != nil {
+			fmt.Printf("error saving spam classifier. Details: %s\n", err)
+			os.Exit(errLoadingClassifier)
+		}
+	},
+}
+
+// readMessages reads the messages of a mbox or eml file, or of all the files
+// in a directory.
+func readMessages(path string) ([][]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return readMessagesFile(path)
+	}
+
+	var messages [][]byte
+	err = filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		fileMessages, err := readMessagesFile(filePath)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, fileMessages...)
+		return nil
+	})
+
+	return messages, err
+}
+
+// readMessagesFile reads a mbox file, that starts with a "From " line, or a
+// file with a single message.
+func readMessagesFile(path string) ([][]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	if !bytes.HasPrefix(content, []byte("From ")) {
+		return [][]byte{content}, nil
+	}
+
+	var messages [][]byte
+	for _, message := range bytes.Split(content[len("From "):], []byte("\nFrom ")) {
+		// the first line is the rest of the "From " separator
+		if i := bytes.IndexByte(message, '\n'); i >= 0 {
+			message = mboxFromQuote.ReplaceAll(message[i+1:], []byte("$1"))
+			messages = append(messages, message)
+		}
+	}
+	return messages, nil
+}
+
+// messageText extracts the subject and the text parts of the message.
+func messageText(raw []byte) string {
+	message, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return string(raw)
+	}
+
+	decoder := new(mime.WordDecoder)
+	subject, err := decoder.DecodeHeader(message.Header.Get("Subject"))
+	if err != nil {
+		subject = message.Header.Get("Subject")
+	}
+
+	return subject + "\n" + partText(message.Header.Get("Content-Type"),
+		message.Header.Get("Content-Transfer-Encoding"), message.Body)
+}
+
+// partText decodes the text of a MIME part, looking inside the multipart
+// parts.
+func partText(contentType, encoding string, body io.Reader) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		var text []string
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err != nil {
+				break
+			}
+			text = append(text, partText(part.Header.Get("Content-Type"),
+				part.Header.Get("Content-Transfer-Encoding"), part))
+		}
+		return strings.Join(text, "\n")
+	}
+
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return ""
+	}
+
+	content, _ := io.ReadAll(io.LimitReader(body, 1<<20))
+	return string(content)
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Possible transports to deliver the e-mails
+const (
+	transportSMTP     = "smtp"
+	transportSendmail = "sendmail"
+	transportLMTP     = "lmtp"
+	transportMaildir  = "maildir"
+	transportMbox     = "mbox"
+	transportIMAP     = "imap"
+)
+
+// transport is a way to deliver an e-mail already built to the recipients.
+// The message is written directly in the connection, pipe or file, and can be
+// written more than once (e.g. failover between mail servers).
+type transport interface {
+	send(from string, to []string, message io.WriterTo) error
+}
+
+// newTransport returns the transport with the given name using the
+// configuration file settings.
+func newTransport(name string) (transport, error) {
+	switch name {
+	case transportSMTP:
+		if len(config.Mailserver) == 0 {
+			return nil, errors.New("missing mail server")
+		}
+		return config.Mailserver, nil
+
+	case transportSendmail:
+		if config.Sendmail.Path == "" {
+			return nil, errors.New("missing sendmail path")
+		}
+		return &config.Sendmail, nil
+
+	case transportLMTP:
+		if config.LMTP.Address == "" {
+			return nil, errors.New("missing LMTP address")
+		}
+		return &config.LMTP, nil
+
+	case transportMaildir:
+		if config.Maildir.Path == "" {
+			return nil, errors.New("missing Maildir path")
+		}
+		return &config.Maildir, nil
+
+	case transportMbox:
+		if config.Mbox.Path == "" {
+			return nil, errors.New("missing mbox path")
+		}
+		return &config.Mbox, nil
+
+	case transportIMAP:
+		if config.IMAP.Address == "" {
+			return nil, errors.New("missing IMAP address")
+		}
+		return &config.IMAP, nil
+	}
+
+	return nil, fmt.Errorf("unknown transport “%s”", name)
+}
+
+// transports delivers the message using many transports at once (e.g. sending
+// to a mailbox and storing a copy in an IMAP folder). It only fails when all
+// the transports fail.
+type transports []transport
+
+func (t transports) send(from string, to []string, message io.WriterTo) error {
+	var errs []string
+	for _, transport := range t {
+		if err := transport.send(from, to, message); err != nil {
+			log.Printf("error delivering e-mail with transport “%T”. Details: %s", transport, err)
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) == len(t) {
+		return fmt.Errorf("all transports failed (%s)", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// sendmailTransport pipes the message to a local sendmail compatible binary,
+// that will read the recipients from the message headers. As blind carbon
+// copies aren't in the message headers, all the recipients are added in a
+// "Bcc" header that sendmail removes before delivering.
+type sendmailTransport struct {
+	Path    string
+	Timeout time.Duration
+}
+
+func (s *sendmailTransport) send(from string, to []string, message io.WriterTo) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, s.Path, "-t", "-i", "-f", from)
+	cmd.Stderr = &stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(stdin)
+	_, err = writer.WriteString("Bcc: " + strings.Join(to, ", ") + "\r\n")
+	if err == nil {
+		_, err = message.WriteTo(writer)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	stdin.Close()
+
+	// the exit status explains better why the message couldn't be written
+	if waitErr := cmd.Wait(); waitErr != nil {
+		return fmt.Errorf("%s (%s)", waitErr, strings.TrimSpace(stderr.String()))
+	}
+
+	return err
+}
+
+// lmtpTransport delivers the message to a local delivery agent (e.g. Dovecot)
+// using the LMTP protocol. The address can be a TCP address with port or an
+// Unix socket path prefixed with "unix:".
+type lmtpTransport struct {
+	Address string
+	Timeout time.Duration
+}
+
+func (l *lmtpTransport) send(from string, to []string, message io.WriterTo) error {
+	network, address := "tcp", l.Address
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	}
+
+	conn, err := net.DialTimeout(network, address, l.Timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(l.Timeout))
+
+	text := textproto.NewConn(conn)
+	defer text.Close()
+
+	if _, _, err := text.ReadResponse(220); err != nil {
+		return err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	if err := lmtpCmd(text, 250, "LHLO %s", hostname); err != nil {
+		return err
+	}
+
+	if err := lmtpCmd(text, 250, "MAIL FROM:<%s>", from); err != nil {
+		return err
+	}
+
+	// recipients rejected are ignored, so the message still reaches the
+	// accepted ones
+	var accepted, errs []string
+	for _, recipient := range to {
+		if err := lmtpCmd(text, 25, "RCPT TO:<%s>", recipient); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", recipient, err))
+			continue
+		}
+		accepted = append(accepted, recipient)
+	}
+
+	if len(accepted) == 0 {
+		return fmt.Errorf("all recipients rejected (%s)", strings.Join(errs, "; "))
+	}
+
+	if err := lmtpCmd(text, 354, "DATA"); err != nil {
+		return err
+	}
+
+	w := text.DotWriter()
+	// the data isn't terminated on errors, so an incomplete message is never
+	// delivered when the connection is closed
+	if _, err := message.WriteTo(w); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	// LMTP answers the data command once for each accepted recipient
+	delivered := 0
+	for _, recipient := range accepted {
+		if _, _, err := text.ReadResponse(250); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", recipient, err))
+			continue
+		}
+		delivered++
+	}
+
+	lmtpCmd(text, 221, "QUIT")
+
+	if delivered == 0 {
+		return fmt.Errorf("LMTP delivery failed (%s)", strings.Join(errs, "; "))
+	}
+
+	if len(errs) > 0 {
+		log.Printf("LMTP delivery failed for some recipients. Details: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// lmtpCmd sends a command to the LMTP server and checks the response code.
+func lmtpCmd(text *textproto.Conn, expectCode int, format string, args ...interface{}) error {
+	id, err := text.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+
+	_, _, err = text.ReadResponse(expectCode)
+	return err
+}
+
+// maildirTransport writes the message directly in a Maildir folder.
+type maildirTransport struct {
+	Path string
+}
+
+func (m *maildirTransport) send(from string, to []string, message io.WriterTo) error {
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(m.Path, dir), 0700); err != nil {
+			return err
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+
+	now := time.Now()
+	filename := fmt.Sprintf("%d.M%dP%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), hostname)
+
+	// the message is written in the tmp directory first, so the mail readers
+	// never see an incomplete message
+	tmpPath := filepath.Join(m.Path, "tmp", filename)
+	if err := writeMessageFile(tmpPath, message); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, filepath.Join(m.Path, "new", filename))
+}
+
+// writeMessageFile creates the file with the message, using the line breaks
+// of the local mailboxes.
+func writeMessageFile(path string, message io.WriterTo) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	lineBreaks := &unixLineBreaksWriter{w: writer}
+
+	_, err = message.WriteTo(lineBreaks)
+	if err == nil {
+		err = lineBreaks.Close()
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// mboxTransport appends the message to a mbox file. The file is locked with a
+// dot-lock while writing, so other mbox readers/writers can cooperate.
+type mboxTransport struct {
+	Path string
+
+	// lock avoids that two deliveries of the same process compete for the
+	// dot-lock
+	lock sync.Mutex
+}
+
+func (m *mboxTransport) send(from string, to []string, message io.WriterTo) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	unlock, err := dotLock(m.Path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	file, err := os.OpenFile(m.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	fmt.Fprintf(writer, "From %s %s\n", from, time.Now().UTC().Format(time.ANSIC))
+
+	mbox := &mboxWriter{w: writer}
+	_, err = message.WriteTo(mbox)
+	if err == nil {
+		err = mbox.Close()
+	}
+	if err == nil {
+		_, err = writer.WriteString("\n")
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// mboxWriter writes the message lines with the line breaks of the local
+// mailboxes, quoting the lines that could be confused with a message
+// separator (mboxrd). Only the current line is kept in memory.
+type mboxWriter struct {
+	w    io.Writer
+	line []byte
+}
+
+func (m *mboxWriter) Write(data []byte) (int, error) {
+	written := len(data)
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			m.line = append(m.line, data...)
+			break
+		}
+
+		m.line = append(m.line, data[:i+1]...)
+		data = data[i+1:]
+
+		if err := m.flushLine(); err != nil {
+			return 0, err
+		}
+	}
+
+	return written, nil
+}
+
+// Close writes the last line, always ending the message with a line break.
+func (m *mboxWriter) Close() error {
+	if len(m.line) == 0 {
+		return nil
+	}
+
+	m.line = append(m.line, '\n')
+	return m.flushLine()
+}
+
+func (m *mboxWriter) flushLine() error {
+	line := bytes.TrimSuffix(bytes.TrimSuffix(m.line, []byte("\n")), []byte("\r"))
+	m.line = m.line[:0]
+
+	if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+		if _, err := m.w.Write([]byte(">")); err != nil {
+			return err
+		}
+	}
+
+	if _, err := m.w.Write(line); err != nil {
+		return err
+	}
+
+	_, err := m.w.Write([]byte("\n"))
+	return err
+}
+
+// dotLock creates the lock file "<path>.lock", waiting for some time if it
+// already exists. It returns the function that removes the lock.
+func dotLock(path string) (func(), error) {
+	lockPath := path + ".lock"
+
+	for i := 0; ; i++ {
+		file, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			file.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+
+		if !os.IsExist(err) || i == 50 {
+			return nil, fmt.Errorf("error locking “%s”. Details: %s", path, err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// unixLineBreaksWriter converts the message line breaks to the format used in
+// local mailboxes while the message is written.
+type unixLineBreaksWriter struct {
+	w  io.Writer
+	cr bool
+}
+
+func (u *unixLineBreaksWriter) Write(data []byte) (int, error) {
+	converted := make([]byte, 0, len(data)+1)
+	for _, b := range data {
+		if u.cr && b != '\n' {
+			converted = append(converted, '\r')
+		}
+
+		if u.cr = b == '\r'; !u.cr {
+			converted = append(converted, b)
+		}
+	}
+
+	if _, err := u.w.Write(converted); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Close writes the carriage return left at the end of the message.
+func (u *unixLineBreaksWriter) Close() error {
+	if !u.cr {
+		return nil
+	}
+
+	u.cr = false
+	_, err := u.w.Write([]byte("\r"))
+	return err
+}
+
+// countingWriter counts the bytes written.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(data []byte) (int, error) {
+	n, err := c.w.Write(data)
+	c.n += int64(n)
+	return n, err
+}
+
+// rawMessage is a message already built in memory, for the small ones like
+// the notifications.
+type rawMessage []byte
+
+func (r rawMessage) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(r)
+	return int64(n), err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEmailMessageWrittenTwice(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "attachment")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("attachment content\n"), 100), 0600); err != nil {
+		t.Fatalf("unexpected error writing attachment. Details: %s", err)
+	}
+
+	message := &emailMessage{
+		header:      []byte("Subject: test\r\n\r\n"),
+		body:        []byte("Hello"),
+		attachments: []attachment{{Filename: "a.txt", ContentType: "text/plain", Path: path}},
+		boundary:    "boundary",
+	}
+
+	var first, second bytes.Buffer
+	n, err := message.WriteTo(&first)
+	if err != nil {
+		t.Fatalf("unexpected error writing message. Details: %s", err)
+	}
+
+	if n != int64(first.Len()) {
+		t.Errorf("unexpected size written: %d (expected %d)", n, first.Len())
+	}
+
+	if _, err := message.WriteTo(&second); err != nil {
+		t.Fatalf("unexpected error writing message again. Details: %s", err)
+	}
+
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Error("message changed when written again")
+	}
+}
+
+func TestUnixLineBreaksWriter(t *testing.T) {
+	var content bytes.Buffer
+	w := &unixLineBreaksWriter{w: &content}
+
+	// the line break is split between the writes
+	for _, data := range []string{"line 1\r", "\nline 2\r\n", "a\rb\r"} {
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatalf("unexpected error writing. Details: %s", err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error closing. Details: %s", err)
+	}
+
+	if expected := "line 1\nline 2\na\rb\r"; content.String() != expected {
+		t.Errorf("unexpected content %q (expected %q)", content.String(), expected)
+	}
+}
+
+func TestMboxWriter(t *testing.T) {
+	var content bytes.Buffer
+	w := &mboxWriter{w: &content}
+
+	for _, data := range []string{"Subject: test\r\n\r\nFro", "m here\r\n>From there\r\nend"} {
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatalf("unexpected error writing. Details: %s", err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error closing. Details: %s", err)
+	}
+
+	if expected := "Subject: test\n\n>From here\n>>From there\nend\n"; content.String() != expected {
+		t.Errorf("unexpected content %q (expected %q)", content.String(), expected)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// commonEmailDomains are the domains used by most of the clients, where the
+// typos are compared.
+var commonEmailDomains = []string{
+	"comcast.net",
+	"gmail.com",
+	"googlemail.com",
+	"hotmail.co.uk",
+	"hotmail.com",
+	"hotmail.fr",
+	"icloud.com",
+	"outlook.com",
+	"protonmail.com",
+	"yahoo.co.uk",
+	"yahoo.com",
+	"yahoo.com.br",
+	"yahoo.fr",
+	"yandex.com",
+	"yandex.ru",
+}
+
+// knownEmailDomains are real mailbox providers that look like typos of the
+// common domains, so they are never corrected.
+var knownEmailDomains = []string{
+	"aim.com",
+	"aol.com",
+	"bol.com",
+	"bol.com.br",
+	"email.com",
+	"gmx.at",
+	"gmx.ch",
+	"gmx.com",
+	"gmx.de",
+	"gmx.net",
+	"hotmail.be",
+	"hotmail.de",
+	"hotmail.es",
+	"hotmail.it",
+	"live.com",
+	"mac.com",
+	"mail.com",
+	"mail.ru",
+	"me.com",
+	"msn.com",
+	"outlook.de",
+	"outlook.es",
+	"outlook.fr",
+	"proton.me",
+	"rocketmail.com",
+	"terra.com.br",
+	"uol.com",
+	"uol.com.br",
+	"web.de",
+	"yahoo.ca",
+	"yahoo.de",
+	"yahoo.es",
+	"yahoo.it",
+	"ymail.com",
+	"zoho.com",
+}
+
+// typoTLDs are the top level domains where the typos of the last label are
+// corrected.
+var typoTLDs = []string{"com", "net", "org", "edu", "gov"}
+
+// plausibleTLDs are top level domains with 3 or more letters that are used
+// in e-mail addresses. The 2 letter ones are country codes and are never
+// corrected, as almost all of them exist.
+var plausibleTLDs = []string{
+	"app", "biz", "cat", "com", "coop", "dev", "edu", "email", "gov", "info",
+	"int", "mil", "name", "net", "online", "org", "pro", "shop", "site",
+	"store", "tech", "xyz",
+}
+
+// suggestEmail returns the address that the client probably meant, when the
+// domain is very similar to a common domain or the top level domain isn't a
+// real one. Known mailbox providers and domains with other top level domains
+// are never corrected, so the suggestion is only a hint.
+func suggestEmail(email string) string {
+	i := strings.LastIndex(email, "@")
+	if i <= 0 {
+		return ""
+	}
+	local, domain := email[:i], strings.ToLower(strings.TrimSpace(email[i+1:]))
+
+	if domain == "" || containsString(commonEmailDomains, domain) || containsString(knownEmailDomains, domain) {
+		return ""
+	}
+
+	j := strings.LastIndexAny(domain, ".,")
+	if j <= 0 || j == len(domain)-1 {
+		return ""
+	}
+	name, tld := domain[:j], domain[j+1:]
+
+	if len(tld) > 2 && !containsString(plausibleTLDs, tld) {
+		fixed := ""
+		for _, candidate := range typoTLDs {
+			if len(candidate) == len(tld) && editDistance(tld, candidate) == 1 {
+				fixed = candidate
+				break
+			}
+		}
+
+		if fixed == "" {
+			return ""
+		}
+		tld = fixed
+	}
+
+	// only the name is compared, so a domain with another top level domain
+	// (e.g. yahoo.de) is never replaced by a common one (e.g. yahoo.fr)
+	best, bestDistance := "", 3
+	for _, common := range commonEmailDomains {
+		k := strings.LastIndex(common, ".")
+		commonName, commonTLD := common[:k], common[k+1:]
+		if commonTLD != tld || len(commonName) < 5 {
+			continue
+		}
+
+		// short names would match too many real domains
+		maxDistance := 2
+		if len(commonName) < 8 {
+			maxDistance = 1
+		}
+
+		if distance := editDistance(name, commonName); distance <= maxDistance && distance < bestDistance {
+			best, bestDistance = commonName, distance
+		}
+	}
+
+	if best != "" {
+		name = best
+	}
+
+	suggestion := name + "." + tld
+	if suggestion == domain {
+		return ""
+	}
+	return local + "@" + suggestion
+}
+
+// containsString checks if the value is in the list.
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// emailSuggestions returns the suggestion for the e-mail field, when the
+// typos check is enabled.
+func emailSuggestions(r *http.Request) map[string]string {
+	if !config.EmailCheck.Typos {
+		return nil
+	}
+
+	if suggestion := suggestEmail(normalizeInput(r.FormValue("email"))); suggestion != "" {
+		return map[string]string{"email": suggestion}
+	}
+	return nil
+}
+
+// editDistance is the number of insertions, deletions, substitutions or
+// transpositions of adjacent characters needed to turn a into b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+
+			d[i][j] = minInt(minInt(d[i-1][j]+1, d[i][j-1]+1), d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				d[i][j] = minInt(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+
+	return d[len(ra)][len(rb)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
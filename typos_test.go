@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestSuggestEmail(t *testing.T) {
+	scenarios := []struct {
+		email    string
+		expected string
+	}{
+		{email: "john@gmial.com", expected: "john@gmail.com"},
+		{email: "john@hotmail.con", expected: "john@hotmail.com"},
+		{email: "john@yahooo.com", expected: "john@yahoo.com"},
+		{email: "john@gmail,com", expected: "john@gmail.com"},
+		{email: "john@hotmial.co.uk", expected: "john@hotmail.co.uk"},
+		{email: "john@gmail.com", expected: ""},
+		{email: "john@ymail.com", expected: ""},
+		{email: "john@hotmail.de", expected: ""},
+		{email: "john@yahoo.de", expected: ""},
+		{email: "john@yahoo.es", expected: ""},
+		{email: "john@gmx.at", expected: ""},
+		{email: "john@uol.com", expected: ""},
+		{email: "john@bol.com", expected: ""},
+		{email: "john@aim.com", expected: ""},
+		{email: "john@email.com", expected: ""},
+		{email: "john@foo.cm", expected: ""},
+		{email: "john@example.com", expected: ""},
+		{email: "john", expected: ""},
+	}
+
+	for _, scenario := range scenarios {
+		if suggestion := suggestEmail(scenario.email); suggestion != scenario.expected {
+			t.Errorf("unexpected suggestion for “%s”: “%s” (expected “%s”)",
+				scenario.email, suggestion, scenario.expected)
+		}
+	}
+}